@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || dragonfly || aix)
+
+package main
+
+// freeBytes can't tell the free space without statfs, so that
+// MinFreeBytes isn't checked.
+func freeBytes(dir string) (int64, error) {
+	return 0, errFreeBytesUnknown
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd || dragonfly || aix
+
+package main
+
+import "syscall"
+
+// freeBytes returns the space available to unprivileged users on the
+// filesystem holding dir.
+func freeBytes(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	statErr := syscall.Statfs(dir, &stat)
+	if statErr != nil {
+		return 0, statErr
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// setNice does nothing, there's no niceness to set outside Unix.
+func setNice(pid int, nice int) error {
+	return nil
+}
@@ -1,18 +1,45 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type JSONConfig struct {
@@ -21,148 +48,6364 @@ type JSONConfig struct {
 	InputDir  string
 	OutputDir string
 	Widths    []int
+	// MaxConcurrentTranscodes caps the number of ffmpeg processes running
+	// at once. Zero means unlimited.
+	MaxConcurrentTranscodes int
+	// Scheduling picks which queued transcode gets the next free slot:
+	// "fifo" (default) or "demand" to favour the file with the most
+	// waiting clients, and have them share one transcode.
+	Scheduling string
+	// MaxConcurrentPerFile caps the transcodes (of different widths or
+	// options) of a single source file running at once, so that one
+	// popular file can't take every slot. Zero means unlimited.
+	MaxConcurrentPerFile int
+	// Loudnorm turns on audio loudness normalisation by default. Requests
+	// can still override it with ?loudnorm=.
+	Loudnorm bool
+	// AdminToken is the bearer token guarding the admin endpoints. They
+	// are disabled when it is empty.
+	AdminToken string
+	// MinFreeBytes is the free space to keep on the OutputDir volume.
+	// Old transcodes are evicted to make room and, failing that, new ones
+	// aren't cached. Zero turns the check off.
+	MinFreeBytes int64
+	// LowDiskMode is either "nocache" (default) to keep streaming without
+	// caching when space is short, or "reject" to respond with a 507.
+	LowDiskMode string
+	// DefaultWidth is the width used for bare /{filename} requests. The
+	// route is disabled when it is zero.
+	DefaultWidth int
+	// Bitrates maps widths to their target video bitrate (e.g. "1500k"),
+	// as used by two-pass encoding. Widths without one fall back to the
+	// CodecBitrates.
+	Bitrates map[int]string
+	// CodecBitrates overrides entries of the built-in defaultBitrates
+	// table of bitrates per codec ("h264", "h265" or "av1") and width.
+	CodecBitrates map[string]map[int]string
+	// CodecQualities overrides entries of the built-in defaultQualities
+	// table of ?quality= settings per codec and quality.
+	CodecQualities map[string]map[string]Quality
+	// TwoPass turns on two-pass encoding by default. Requests can still
+	// override it with ?twopass=.
+	TwoPass bool
+	// MaxFPS maps widths to their default frame rate cap. Requests can
+	// still override it with ?fps=.
+	MaxFPS map[int]int
+	// ErrorVideo and ErrorPoster are served instead of a text error when
+	// the source is missing or the transcode fails, with ErrorPoster
+	// going to clients asking for an image.
+	ErrorVideo  string
+	ErrorPoster string
+	// ErrorAssetStatusOK serves the error assets with a 200 for players
+	// that refuse to show anything else.
+	ErrorAssetStatusOK bool
+	// MinInputBytes is the smallest source file that is worth handing to
+	// ffmpeg. Empty files are always rejected.
+	MinInputBytes int64
+	// Metadata is written into every output (e.g. "title", "comment").
+	// Requests can add or override entries with ?meta_<key>=<value>.
+	Metadata map[string]string
+	// CopyMetadata carries the source's metadata over to the outputs.
+	CopyMetadata bool
+	// StartupWarning logs a warning when ffmpeg hasn't produced any
+	// output that long after starting, and StartupTimeout aborts the
+	// transcode. Both are off when zero.
+	StartupWarning Duration
+	StartupTimeout Duration
+	// AllowedExtensions lists the source file extensions (e.g. "mp4",
+	// "mkv") that may be transcoded. Empty allows every file.
+	AllowedExtensions []string
+	// Catalog maps requested filenames to the source files under InputDir
+	// that are served for them. Filenames it doesn't list are served as
+	// they are.
+	Catalog map[string]string
+	// Denylist holds path.Match patterns (e.g. "private/*") of filenames
+	// that are never served, whether requested or mapped by the Catalog.
+	// Both are reloaded on SIGHUP and POST /admin/reload.
+	Denylist []string
+	// ShutdownTimeout is how long to wait for in-flight streams to finish
+	// on SIGINT/SIGTERM before closing them. Defaults to 10s.
+	ShutdownTimeout Duration
+	// SpriteInterval (in seconds), SpriteColumns, SpriteRows and
+	// SpriteWidth are the default layout of the scrubbing sprite sheets.
+	SpriteInterval int
+	SpriteColumns  int
+	SpriteRows     int
+	SpriteWidth    int
+	// PreviewWidth is the width of the hover previews. Defaults to 320.
+	PreviewWidth int
+	// FFmpegNice is the niceness (-20 to 19) ffmpeg runs at, so that
+	// transcoding can yield to more important work on a shared host.
+	FFmpegNice int
+	// CachePartition is "none" (default) or "daily" to store transcodes
+	// in a directory per day, so that old days can be dropped wholesale.
+	CachePartition string
+	// CacheLookbackDays is how many days before today are searched for a
+	// cached transcode with daily partitioning.
+	CacheLookbackDays int
+	// MultiAudio emits a stereo track alongside the surround track by
+	// default. Requests can override it with ?audio=multi or
+	// ?audio=single.
+	MultiAudio bool
+	// AudioChannels downmixes the audio to 1, 2 or 6 channels by default.
+	// Requests can override it with ?channels=. Zero keeps the source's.
+	AudioChannels int
+	// HeadUncached is the answer to a HEAD for a file that isn't cached
+	// yet: "ok" (default) for a 200 with the expected Content-Type, or
+	// "notfound" for a 404. Either way no transcode is started.
+	HeadUncached string
+	// MaxVideoBitrate is the ceiling for every encode: higher requested
+	// or configured bitrates are clamped to it, and encodes without a
+	// target bitrate are capped to it.
+	MaxVideoBitrate string
+	// CaseInsensitivePaths matches filenames in URLs to the source files
+	// regardless of case, using the case on disk for the cache.
+	CaseInsensitivePaths bool
+	// Tenants lists the cache namespaces clients may pick with an
+	// X-Tenant header or ?ns=. Requests without one use "default".
+	Tenants []string
+	// Tunes maps widths to their default x264 -tune (e.g. "film" or
+	// "animation"). Requests can override it with ?tune=.
+	Tunes map[int]string
+	// ProbeSize (in bytes) and AnalyzeDuration are how much of the input
+	// ffmpeg and ffprobe read to detect its streams. Raise them for
+	// inputs such as broadcast MPEG-TS captures whose audio or subtitle
+	// tracks go missing. Zero keeps ffmpeg's defaults.
+	ProbeSize       int64
+	AnalyzeDuration Duration
+	// AllowInterpolation enables ?interpolate=1, motion-compensated frame
+	// rate conversion. It is very CPU-heavy, hence off by default.
+	AllowInterpolation bool
+	// AllowBurnSubtitles enables ?burnsub=N, rendering a subtitle track
+	// into the video for players that can't show subtitles themselves.
+	AllowBurnSubtitles bool
+	// ValidateCacheOnHit checks the MP4 structure of cached files before
+	// serving them, transcoding again those that are truncated or
+	// corrupt.
+	ValidateCacheOnHit bool
+	// MaxCacheFiles caps the number of files in OutputDir, evicting the
+	// oldest ones when it is exceeded, so that lots of small files can't
+	// run the filesystem out of inodes. Zero means unlimited.
+	MaxCacheFiles int64
+	// FragmentedMP4 writes the cached files as fragmented MP4 with a
+	// keyframe every two seconds, so that fragment-based players can
+	// consume them as well as progressive ones.
+	FragmentedMP4 bool
+	// WebhookURL is POSTed a JSON description of every transcode once it
+	// completes, fails or is cancelled, signed with WebhookSecret.
+	WebhookURL    string
+	WebhookSecret string
+	// TailInProgress serves clients asking for an output that is already
+	// being transcoded from the growing cache file, rather than starting
+	// another ffmpeg. It needs FragmentedMP4, as a plain MP4 can't be
+	// played until it is complete.
+	TailInProgress bool
+	// PathPrefix is the path the server is mounted under behind a reverse
+	// proxy, e.g. "/video". It is stripped from request paths and added
+	// to the URLs the server hands out.
+	PathPrefix string
+	// Profile and Level are the default H.264 profile ("baseline",
+	// "main" or "high") and level (e.g. "3.0") for compatibility with
+	// older devices. Requests can override them with ?profile= and
+	// ?level=.
+	Profile string
+	Level   string
+	// AllowedOverrides lists the encoding query parameters clients may
+	// set, out of encoderOverrides ("meta" standing for every meta_<key>).
+	// Unset, it is defaultOverrides.
+	AllowedOverrides []string
+	// SlowTranscodeRatio logs a warning for transcodes encoding slower
+	// than that many seconds of video per second (e.g. 1 for real time),
+	// a sign of too little CPU. Zero turns the check off.
+	SlowTranscodeRatio float64
+	// AudioVisualization turns audio-only sources into a video of their
+	// "waves" or "spectrum", so that they can play in a <video>. Empty
+	// leaves them alone.
+	AudioVisualization string
+	// MemCacheBytes is the size of the in-memory cache of small cached
+	// files (sprites, short transcodes), served without reading the
+	// disk. Zero turns it off.
+	MemCacheBytes int64
+	// Debug logs routine events such as clients going away in the
+	// middle of a stream.
+	Debug bool
+	// OutputDirs stores the renditions of some widths in their own
+	// directory, e.g. on cheaper disks for the large ones, instead of
+	// OutputDir/{width}.
+	OutputDirs map[int]string
+	// KeepRotation leaves the frames of rotated sources, typically phone
+	// videos, as they are and carries their rotation flag over to the
+	// output instead of turning them upright.
+	KeepRotation bool
+	// FlushInterval coalesces the flushes of streamed responses to at
+	// most one per interval (or flushThreshold bytes), instead of one
+	// per read from ffmpeg. Zero flushes every read.
+	FlushInterval Duration
+	// FFmpegInputArgs and FFmpegOutputArgs are extra ffmpeg options
+	// added before the input and to every output of a transcode. Only
+	// the flags in ffmpegInputFlags and ffmpegOutputFlags are accepted.
+	FFmpegInputArgs  []string
+	FFmpegOutputArgs []string
+	// FileOpTimeout bounds opening a source file in InputDir, so that a
+	// hung network mount gets a 504 instead of blocking the request
+	// forever. Zero waits for as long as it takes.
+	FileOpTimeout Duration
+	// Codec is the video codec of the outputs, "h264" (default) or
+	// "h265". Clients that can't play HEVC ask for ?fallback=h264.
+	Codec string
+	// MaxQueueLength caps the requests waiting for a transcode slot.
+	// Past it, requests get a 503 straight away instead of queueing.
+	// Zero means unlimited.
+	MaxQueueLength int
+	// ConstantFrameRate forces every output to a constant frame rate,
+	// fixing the audio drifting out of sync with variable frame rate
+	// sources. AutoConstantFrameRate only does so for the sources ffprobe
+	// finds to be variable, at their average frame rate. Requests can ask
+	// for it with ?cfr=.
+	ConstantFrameRate     int
+	AutoConstantFrameRate bool
+	// CacheVersion goes into every cache key, so that changing it, e.g.
+	// after upgrading ffmpeg, makes every cached output stale at once.
+	// "auto" derives it from the output of ffmpeg -version.
+	CacheVersion string
+	// HardwareEncoder encodes single-pass transcodes on the GPU: "nvenc"
+	// or "" for software. With HardwareFallback, transcodes the GPU
+	// refuses a session for, typically because all of them are taken,
+	// are encoded in software instead of failing.
+	HardwareEncoder  string
+	HardwareFallback bool
+	// FallbackWait is how long the response headers of a transcode are
+	// held back for ffmpeg to fail, with HardwareFallback or
+	// DegradeToAudio, so that it can be started again differently.
+	// Defaults to 1s, and ends as soon as ffmpeg sends its first bytes.
+	FallbackWait Duration
+	// WatchInputDir polls InputDir every WatchInterval (default 1m) and
+	// purges the cached outputs of the source files that changed or
+	// were removed. Each poll lists the directories that changed, and
+	// every tenth walks the whole of InputDir.
+	WatchInputDir bool
+	WatchInterval Duration
+	// MaxBytesPerSecond throttles every response to that rate, so that a
+	// few fast clients can't take all of the bandwidth. The first
+	// BurstBytes of each response are sent as fast as possible, letting
+	// playback start without stalling. Zero turns the throttle off.
+	MaxBytesPerSecond int64
+	BurstBytes        int64
+	// StateFile is where the in-flight transcodes are recorded on
+	// shutdown. With ResumeOnStart they are transcoded into the cache
+	// again once the server is back up, and the file is removed.
+	StateFile     string
+	ResumeOnStart bool
+	// ToneMapping enables ?tonemap=1, converting HDR sources to SDR.
+	// AutoToneMapping does so for every source ffprobe finds to be HDR.
+	// Both need an ffmpeg built with zimg for the zscale filter.
+	ToneMapping     bool
+	AutoToneMapping bool
+	// ShortClips probes every source so that clips shorter than a second,
+	// such as GIFs turned into MP4s, are encoded with every frame a
+	// keyframe. StillImages serves single-frame sources as a JPEG of the
+	// requested width instead of a one-frame video.
+	ShortClips  bool
+	StillImages bool
+	// AllowPictureInPicture enables /pip/{main}/{overlay}, compositing a
+	// scaled down overlay video onto a main one.
+	AllowPictureInPicture bool
+	// TranscodeTimeout aborts transcodes still running that long after
+	// they got a slot. TranscodeTimeoutRatio scales the limit to the
+	// length of the source instead, e.g. 4 gives a 10 minute video 40
+	// minutes, kept between TranscodeTimeoutMin and TranscodeTimeoutMax.
+	// With both, the stricter limit applies. All are off when zero.
+	TranscodeTimeout      Duration
+	TranscodeTimeoutRatio float64
+	TranscodeTimeoutMin   Duration
+	TranscodeTimeoutMax   Duration
+	// RespectSaveData serves clients sending Save-Data: on the next width
+	// down from the one requested, or SaveDataWidth when it is set and
+	// smaller.
+	RespectSaveData bool
+	SaveDataWidth   int
+	// X265Params are passed to libx265 with -x265-params for the h265
+	// outputs, e.g. {"aq-mode": "3"}. Only the x265ParamKeys may be set,
+	// here or by requests with ?x265params=key=value:key=value.
+	X265Params map[string]string
+	// FFmpegLogDir gets the ffmpeg log of every transcode in a file of
+	// its own, named after the X-Request-Id, instead of the server's
+	// stderr. Logs older than FFmpegLogRetention (default 7 days) are
+	// removed.
+	FFmpegLogDir       string
+	FFmpegLogRetention Duration
+	// PurgeInFlight is what purging the cached outputs of a source does
+	// to its in-flight transcodes, which would otherwise put stale
+	// outputs back in the cache: "wait" (default) for them to finish,
+	// or "cancel" them.
+	PurgeInFlight string
+	// ColorPrimaries, ColorTransfer and ColorSpace tag the outputs with
+	// -color_primaries, -color_trc and -colorspace, e.g. "bt709", so that
+	// players don't have to guess, or "source" to copy the tag from the
+	// source, which takes an ffprobe of every source transcoded. Those
+	// left empty are left out.
+	ColorPrimaries string
+	ColorTransfer  string
+	ColorSpace     string
+	// InputFormats maps source extensions (e.g. "ts", or "" for files
+	// without one) to the demuxer forced with -f for them, such as
+	// "mpegts", for raw streams ffmpeg can't detect. Others are detected.
+	InputFormats map[string]string
+	// PurgeRemovedWidths removes, on start, the OutputDir/{width}
+	// directories of widths no longer in Widths, whose renditions can't
+	// be requested any more.
+	PurgeRemovedWidths bool
+	// DegradeToAudio serves an audio-only MP4, marked with an X-Degraded
+	// header, for sources whose video ffmpeg fails to decode from the
+	// start but whose audio is fine, rather than failing the request.
+	// Only failures within the FallbackWait are caught. Damage further
+	// in is skipped over instead.
+	DegradeToAudio bool
+	// CacheTTL is how long cached files are served for: older transcodes
+	// are done again when requested, and every cached file is removed
+	// once it is this old. Zero keeps them until evicted or purged.
+	CacheTTL Duration
+	// AllowTranscodeDeadline honours the X-Transcode-Deadline request
+	// header, an RFC 3339 time or a duration such as "30s" after which
+	// the client gives up, tearing the transcode down then. It can only
+	// make the TranscodeTimeout stricter.
+	AllowTranscodeDeadline bool
 }
 
+// Duration is a time.Duration given in the config as a string such as
+// "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	unmarshalErr := json.Unmarshal(data, &str)
+	if unmarshalErr != nil {
+		return unmarshalErr
+	}
+	duration, parseErr := time.ParseDuration(str)
+	if parseErr != nil {
+		return parseErr
+	}
+	d.Duration = duration
+	return nil
+}
+
+var config JSONConfig
+var urlRegex = regexp.MustCompile("^/(?P<width>\\d+)p/(?P<filename>.*?)$")
+
+// maxFPS is the highest frame rate cap that can be asked for.
+const maxFPS = 120
+
+// metadataKeyRegex matches the metadata keys that can safely be passed to
+// ffmpeg's -metadata.
+var metadataKeyRegex = regexp.MustCompile("^[A-Za-z0-9_]+$")
+
+const maxMetadataLength = 1024
+
+var bitrateRegex = regexp.MustCompile("^[0-9]+[kKmM]?$")
+
+var namespaceRegex = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// cacheVersionRegex matches the CacheVersions that can go into file names.
+var cacheVersionRegex = regexp.MustCompile("^[A-Za-z0-9._-]+$")
+
+// defaultBitrates are the bitrates per codec and width used when a target
+// bitrate is needed and none was given. They aim at the same quality for
+// every codec, h265 needing about 60% and av1 about 50% of h264's bitrate.
+var defaultBitrates = map[string]map[int]string{
+	"h264": {240: "400k", 360: "750k", 480: "1200k", 720: "2500k", 1080: "5M", 1440: "9M", 2160: "16M"},
+	"h265": {240: "250k", 360: "450k", 480: "700k", 720: "1500k", 1080: "3M", 1440: "5500k", 2160: "10M"},
+	"av1":  {240: "200k", 360: "375k", 480: "600k", 720: "1250k", 1080: "2500k", 1440: "4500k", 2160: "8M"},
+}
+
+// Quality is the encoder setting behind a ?quality= level: a constant
+// rate factor and a speed preset.
+type Quality struct {
+	CRF    int
+	Preset string
+}
+
+// defaultQualities maps the ?quality= levels to encoder settings per
+// codec. The CRF scales differ between encoders, av1's going up to 63.
+var defaultQualities = map[string]map[string]Quality{
+	"h264": {"low": {CRF: 28, Preset: "veryfast"}, "medium": {CRF: 23, Preset: "medium"}, "high": {CRF: 18, Preset: "slow"}},
+	"h265": {"low": {CRF: 30, Preset: "veryfast"}, "medium": {CRF: 26, Preset: "medium"}, "high": {CRF: 21, Preset: "slow"}},
+	"av1":  {"low": {CRF: 40, Preset: "10"}, "medium": {CRF: 32, Preset: "8"}, "high": {CRF: 24, Preset: "6"}},
+}
+
+// x264Presets are the -preset values libx264 and libx265 accept.
+var x264Presets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+
+// x264Tunes are the -tune values libx264 accepts, and x265Tunes those
+// of libx265.
+var x264Tunes = []string{"film", "animation", "grain", "stillimage", "fastdecode", "zerolatency", "psnr", "ssim"}
+var x265Tunes = []string{"animation", "grain", "fastdecode", "zerolatency", "psnr", "ssim"}
+
+// x265ParamKeys are the X265Params that may be set: quality and speed
+// tuning only, nothing reading or writing files or changing the rate
+// control mode.
+var x265ParamKeys = []string{
+	"aq-mode", "aq-strength", "psy-rd", "psy-rdoq", "bframes", "b-adapt", "ref", "rd", "me", "subme",
+	"merange", "deblock", "sao", "no-sao", "limit-sao", "selective-sao", "rc-lookahead", "lookahead-slices",
+	"strong-intra-smoothing", "no-strong-intra-smoothing", "keyint", "min-keyint", "scenecut", "ctu",
+	"max-tu-size", "tu-intra-depth", "tu-inter-depth", "weightb", "early-skip", "cutree", "no-cutree",
+	"rskip", "qcomp", "ipratio", "pbratio", "rect", "amp", "limit-modes", "limit-refs",
+}
+
+// x265ParamValueRegex matches the X265Params values, which can't contain
+// the : and = separating them.
+var x265ParamValueRegex = regexp.MustCompile("^[A-Za-z0-9.,+-]{1,16}$")
+
+// colorTagRegex matches the ColorPrimaries, ColorTransfer and ColorSpace,
+// and the tags ffprobe reports, such as "bt709" or "arib-std-b67".
+var colorTagRegex = regexp.MustCompile("^[a-z0-9_-]{1,32}$")
+
+// demuxerRegex matches the names of ffmpeg demuxers.
+var demuxerRegex = regexp.MustCompile("^[a-z0-9_]{1,32}$")
+
+// encoderOverrides are the query parameters changing the encoding, which
+// clients may only use when they are in the AllowedOverrides.
+var encoderOverrides = []string{"loudnorm", "twopass", "fps", "cfr", "interpolate", "burnsub", "tonemap", "tune", "lowlatency", "profile", "level", "vtrack", "audio", "channels", "quality", "meta", "bitrate", "x265params"}
+
+// defaultOverrides are the AllowedOverrides when none are configured:
+// everything but the ones that cost a lot of CPU, let clients write
+// into the outputs or reach into the encoder's internals.
+var defaultOverrides = []string{"loudnorm", "fps", "cfr", "interpolate", "burnsub", "tonemap", "tune", "lowlatency", "profile", "level", "vtrack", "audio", "channels", "quality"}
+
+// x264Profiles are the -profile:v values libx264 accepts for the 8-bit
+// 4:2:0 output, and x264Levels the -level values.
+var x264Profiles = []string{"baseline", "main", "high"}
+var x264Levels = []string{"1", "1b", "1.1", "1.2", "1.3", "2", "2.1", "2.2", "3", "3.1", "3.2", "4", "4.1", "4.2", "5", "5.1", "5.2", "6", "6.1", "6.2"}
+
+// ffmpegInputFlags and ffmpegOutputFlags are the flags allowed in
+// FFmpegInputArgs and FFmpegOutputArgs, mapped to whether they take a
+// value. Anything naming a file or another output (-i, -f, -report,
+// -filter_script...) is deliberately missing.
+var ffmpegInputFlags = map[string]bool{
+	"-fflags":            true,
+	"-err_detect":        true,
+	"-thread_queue_size": true,
+	"-flags":             true,
+	"-discard":           true,
+	"-hwaccel":           true,
+	"-re":                false,
+	"-ignore_unknown":    false,
+}
+var ffmpegOutputFlags = map[string]bool{
+	"-max_muxing_queue_size": true,
+	"-threads":               true,
+	"-preset":                true,
+	"-g":                     true,
+	"-keyint_min":            true,
+	"-sc_threshold":          true,
+	"-bf":                    true,
+	"-refs":                  true,
+	"-avoid_negative_ts":     true,
+	"-muxdelay":              true,
+	"-muxpreload":            true,
+	"-fps_mode":              true,
+	"-shortest":              false,
+}
+
+var queue *transcodeQueue
+var jobs = newJobRegistry()
+var growing = newGrowingRegistry()
+
+// cacheFiles is the running count of files in OutputDir, kept when
+// MaxCacheFiles is set so that the cap can be checked without walking the
+// cache. Every eviction walk brings it back in sync with the disk.
+var cacheFiles int64
+
+// queueRejected counts the requests turned away because MaxQueueLength
+// requests were already waiting.
+var queueRejected int64
+
+// hardwareFallbacks counts the transcodes encoded in software because
+// the hardware encoder had no session left, see HardwareFallback.
+var hardwareFallbacks int64
+
+// slowTranscodes counts the transcodes that fell below the
+// SlowTranscodeRatio.
+var slowTranscodes int64
+
+// encoderUnavailable counts the ffmpeg and ffprobe runs that failed as
+// their binary couldn't be found.
+var encoderUnavailable int64
+
+// stats are the counters behind GET /admin/stats.
+var stats *serverStats
+
+// memCache holds the small cached files in memory, see MemCacheBytes.
+var memCache *memoryCache
+
+// evictMu keeps evictions from walking the cache concurrently.
+var evictMu sync.Mutex
+
+// evictions wakes evictExcessFiles, see cacheAdded.
+var evictions = make(chan struct{}, 1)
+
 func main() {
-	var configFile string
 	flag.StringVar(&configFile, "config", "config.json", "JSON Config file")
+	flag.Parse()
+	// The -config flag wins over VSE_CONFIG, which wins over the default.
+	// Only a missing default file is fine, the config can then come from
+	// the environment alone.
+	configFileSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			configFileSet = true
+		}
+	})
+	if configFileSet == false && os.Getenv("VSE_CONFIG") != "" {
+		configFile = os.Getenv("VSE_CONFIG")
+		configFileSet = true
+	}
 	data, configFileErr := ioutil.ReadFile(configFile)
-	if configFileErr != nil {
+	if configFileErr != nil && (configFileSet || os.IsNotExist(configFileErr) == false) {
 		log.Fatal("Config file not found")
 	}
-	var config JSONConfig
-	unmarshalErr := json.Unmarshal(data, &config)
-	if unmarshalErr != nil {
-		log.Fatal("Invalid Config file")
+	if configFileErr == nil {
+		unmarshalErr := json.Unmarshal(data, &config)
+		if unmarshalErr != nil {
+			log.Fatal("Invalid Config file")
+		}
+	} else {
+		// Nor is there a file to read again on a reload.
+		configFile = ""
+	}
+	envErr := loadConfigEnv(&config)
+	if envErr != nil {
+		log.Fatal(envErr)
+	}
+	if config.Scheduling != "" && config.Scheduling != "fifo" && config.Scheduling != "demand" {
+		log.Fatal("Invalid Scheduling")
+	}
+	if config.LowDiskMode != "" && config.LowDiskMode != "nocache" && config.LowDiskMode != "reject" {
+		log.Fatal("Invalid LowDiskMode")
+	}
+	if config.PurgeInFlight != "" && config.PurgeInFlight != "wait" && config.PurgeInFlight != "cancel" {
+		log.Fatal("Invalid PurgeInFlight")
+	}
+	overlapErr := checkOverlap()
+	if overlapErr != nil {
+		log.Fatal(overlapErr)
+	}
+	if config.DefaultWidth != 0 {
+		found := false
+		for _, ii := range config.Widths {
+			if ii == config.DefaultWidth {
+				found = true
+			}
+		}
+		if found == false {
+			log.Fatal("DefaultWidth must be one of Widths")
+		}
+	}
+	if config.SaveDataWidth != 0 {
+		found := false
+		for _, ii := range config.Widths {
+			if ii == config.SaveDataWidth {
+				found = true
+			}
+		}
+		if found == false {
+			log.Fatal("SaveDataWidth must be one of Widths")
+		}
+	}
+	for width, bitrate := range config.Bitrates {
+		if bitrateRegex.MatchString(bitrate) == false {
+			log.Fatalf("Invalid bitrate %q for width %d", bitrate, width)
+		}
+	}
+	for width, fps := range config.MaxFPS {
+		if fps < 1 || fps > maxFPS {
+			log.Fatalf("Invalid MaxFPS %d for width %d", fps, width)
+		}
+	}
+	for key, value := range config.Metadata {
+		if metadataKeyRegex.MatchString(key) == false || len(value) > maxMetadataLength {
+			log.Fatalf("Invalid Metadata %q", key)
+		}
+	}
+	if config.CachePartition != "" && config.CachePartition != "none" && config.CachePartition != "daily" {
+		log.Fatal("Invalid CachePartition")
+	}
+	if config.HeadUncached != "" && config.HeadUncached != "ok" && config.HeadUncached != "notfound" {
+		log.Fatal("Invalid HeadUncached")
+	}
+	if config.AudioChannels != 0 && config.AudioChannels != 1 && config.AudioChannels != 2 && config.AudioChannels != 6 {
+		log.Fatal("Invalid AudioChannels")
+	}
+	if config.ConstantFrameRate < 0 || config.ConstantFrameRate > maxFPS {
+		log.Fatal("Invalid ConstantFrameRate")
+	}
+	if config.CacheVersion == "auto" {
+		config.CacheVersion = ffmpegVersion()
+	}
+	if config.TranscodeTimeout.Duration < 0 || config.TranscodeTimeoutRatio < 0 || config.TranscodeTimeoutMin.Duration < 0 ||
+		(config.TranscodeTimeoutMax.Duration > 0 && config.TranscodeTimeoutMax.Duration < config.TranscodeTimeoutMin.Duration) {
+		log.Fatal("Invalid TranscodeTimeout")
+	}
+	if (config.ToneMapping || config.AutoToneMapping) && ffmpegHasFilter("zscale") == false {
+		log.Fatal("ToneMapping needs an ffmpeg built with zimg (--enable-libzimg) for the zscale filter")
+	}
+	inputFormats := make(map[string]string)
+	for ext, format := range config.InputFormats {
+		if demuxerRegex.MatchString(format) == false || ffmpegHasDemuxer(format) == false {
+			log.Fatalf("Invalid InputFormats demuxer %q for %q", format, ext)
+		}
+		inputFormats[strings.ToLower(strings.TrimPrefix(ext, "."))] = format
+	}
+	config.InputFormats = inputFormats
+	if config.CacheVersion != "" && cacheVersionRegex.MatchString(config.CacheVersion) == false {
+		log.Fatal("Invalid CacheVersion")
+	}
+	if config.PreviewWidth < 0 {
+		log.Fatal("Invalid PreviewWidth")
+	}
+	if config.MaxQueueLength < 0 {
+		log.Fatal("Invalid MaxQueueLength")
+	}
+	if config.FFmpegNice < -20 || config.FFmpegNice > 19 {
+		log.Fatal("Invalid FFmpegNice")
+	}
+	badArg := checkFFmpegArgs(config.FFmpegInputArgs, ffmpegInputFlags)
+	if badArg != "" {
+		log.Fatalf("Invalid FFmpegInputArgs %q", badArg)
+	}
+	badArg = checkFFmpegArgs(config.FFmpegOutputArgs, ffmpegOutputFlags)
+	if badArg != "" {
+		log.Fatalf("Invalid FFmpegOutputArgs %q", badArg)
+	}
+	if config.ProbeSize < 0 || config.AnalyzeDuration.Duration < 0 {
+		log.Fatal("Invalid ProbeSize or AnalyzeDuration")
+	}
+	if config.MaxVideoBitrate != "" && bitrateRegex.MatchString(config.MaxVideoBitrate) == false {
+		log.Fatal("Invalid MaxVideoBitrate")
+	}
+	for width, tune := range config.Tunes {
+		if stringInSlice(tune, x264Tunes) == false {
+			log.Fatalf("Invalid tune %q for width %d", tune, width)
+		}
+	}
+	for key, value := range config.X265Params {
+		if stringInSlice(key, x265ParamKeys) == false || x265ParamValueRegex.MatchString(value) == false {
+			log.Fatalf("Invalid X265Params %q", key)
+		}
+	}
+	for name, tag := range map[string]string{"ColorPrimaries": config.ColorPrimaries, "ColorTransfer": config.ColorTransfer, "ColorSpace": config.ColorSpace} {
+		if tag != "" && colorTagRegex.MatchString(tag) == false {
+			log.Fatalf("Invalid %s", name)
+		}
+	}
+	if config.AllowedOverrides == nil {
+		config.AllowedOverrides = defaultOverrides
+	}
+	for _, override := range config.AllowedOverrides {
+		if stringInSlice(override, encoderOverrides) == false {
+			log.Fatalf("Invalid override %q", override)
+		}
+	}
+	if config.HardwareEncoder != "" && config.HardwareEncoder != "nvenc" {
+		log.Fatal("Invalid HardwareEncoder")
+	}
+	if config.Codec != "" && config.Codec != "h264" && config.Codec != "h265" {
+		log.Fatal("Invalid Codec")
+	}
+	if config.Profile != "" && stringInSlice(config.Profile, x264Profiles) == false {
+		log.Fatal("Invalid Profile")
+	}
+	if config.Level != "" && stringInSlice(normalizeLevel(config.Level), x264Levels) == false {
+		log.Fatal("Invalid Level")
+	}
+	for _, tenant := range config.Tenants {
+		if namespaceRegex.MatchString(tenant) == false {
+			log.Fatalf("Invalid tenant %q", tenant)
+		}
+	}
+	for codec, bitrates := range config.CodecBitrates {
+		if defaultBitrates[codec] == nil {
+			log.Fatalf("Invalid codec %q in CodecBitrates", codec)
+		}
+		for width, bitrate := range bitrates {
+			if bitrateRegex.MatchString(bitrate) == false {
+				log.Fatalf("Invalid bitrate %q for %s width %d", bitrate, codec, width)
+			}
+		}
+	}
+	for codec, qualities := range config.CodecQualities {
+		if defaultQualities[codec] == nil {
+			log.Fatalf("Invalid codec %q in CodecQualities", codec)
+		}
+		for level, quality := range qualities {
+			if defaultQualities[codec][level] == (Quality{}) || quality.CRF < 0 || quality.CRF > 63 {
+				log.Fatalf("Invalid quality %q for %s", level, codec)
+			}
+			if codec != "av1" && quality.Preset != "" && stringInSlice(quality.Preset, x264Presets) == false {
+				log.Fatalf("Invalid preset %q for %s quality %q", quality.Preset, codec, level)
+			}
+		}
+	}
+	if config.TailInProgress && config.FragmentedMP4 == false {
+		log.Fatal("TailInProgress needs FragmentedMP4")
+	}
+	if config.PathPrefix != "" && strings.HasPrefix(config.PathPrefix, "/") == false {
+		log.Fatal("PathPrefix must start with /")
+	}
+	config.PathPrefix = strings.TrimRight(config.PathPrefix, "/")
+	if config.AudioVisualization != "" && config.AudioVisualization != "waves" && config.AudioVisualization != "spectrum" {
+		log.Fatal("Invalid AudioVisualization")
+	}
+	if config.MemCacheBytes < 0 {
+		log.Fatal("Invalid MemCacheBytes")
+	}
+	memCache = newMemoryCache(config.MemCacheBytes)
+	if config.SlowTranscodeRatio < 0 {
+		log.Fatal("Invalid SlowTranscodeRatio")
+	}
+	if config.MaxCacheFiles < 0 {
+		log.Fatal("Invalid MaxCacheFiles")
+	}
+	for width, dir := range config.OutputDirs {
+		if width <= 0 || dir == "" {
+			log.Fatal("Invalid OutputDirs")
+		}
+	}
+	if config.FFmpegLogDir != "" {
+		logDirErr := os.MkdirAll(config.FFmpegLogDir, os.ModePerm)
+		if logDirErr != nil {
+			log.Fatalf("Invalid FFmpegLogDir: %s", logDirErr)
+		}
+		retention := config.FFmpegLogRetention.Duration
+		if retention <= 0 {
+			retention = 7 * 24 * time.Hour
+		}
+		go expireFFmpegLogs(retention)
+	}
+	if config.WatchInputDir {
+		watchInterval := config.WatchInterval.Duration
+		if watchInterval <= 0 {
+			watchInterval = time.Minute
+		}
+		go watchInputDir(watchInterval)
+	}
+	if config.PurgeRemovedWidths {
+		purgeRemovedWidths()
+	}
+	if config.CacheTTL.Duration < 0 {
+		log.Fatal("Invalid CacheTTL")
+	}
+	if config.CacheTTL.Duration > 0 {
+		go expireCache()
+	}
+	if config.MaxCacheFiles > 0 {
+		go evictExcessFiles()
+		// Count the files already in the cache.
+		evictCache("", 0, 0)
+		cacheAdded(0)
+	}
+	queue = newTranscodeQueue(config.MaxConcurrentTranscodes, config.MaxConcurrentPerFile, config.MaxQueueLength, config.Scheduling == "demand")
+	stats = newServerStats(config.Widths)
+
+	rules, rulesErr := newSourceRules(config)
+	if rulesErr != nil {
+		log.Fatal(rulesErr)
+	}
+	sources = rules
+	go func() {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		for range hangups {
+			_, reloadErr := reloadSources()
+			if reloadErr != nil {
+				log.Printf("Reload failed, keeping the current Catalog and Denylist: %s", reloadErr)
+			}
+		}
+	}()
+
+	var openConns int64
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", config.Host, config.Port),
+		Handler: newHandler(),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				atomic.AddInt64(&openConns, 1)
+			case http.StateHijacked, http.StateClosed:
+				atomic.AddInt64(&openConns, -1)
+			}
+		},
+	}
+	// ListenAndServe returns as soon as Shutdown is called, shutdownDone
+	// keeps main around until the streams are done.
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		if config.StateFile != "" {
+			saveJobs()
+		}
+		shutdownTimeout := config.ShutdownTimeout.Duration
+		if shutdownTimeout == 0 {
+			shutdownTimeout = 10 * time.Second
+		}
+		log.Printf("Shutting down, waiting up to %s for streams to finish", shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		shutdownErr := server.Shutdown(ctx)
+		if shutdownErr != nil {
+			log.Printf("Shutdown timed out, closing %d connections", atomic.LoadInt64(&openConns))
+			server.Close()
+		}
+	}()
+	listener, listenErr := net.Listen("tcp", server.Addr)
+	if listenErr != nil {
+		log.Fatal(listenErr)
+	}
+	if config.StateFile != "" && config.ResumeOnStart {
+		saved := loadJobs()
+		if len(saved) > 0 {
+			log.Printf("Resuming %d transcodes from %s", len(saved), config.StateFile)
+			go resumeJobs(listener.Addr().String(), saved)
+		}
+	}
+	serverErr := server.Serve(listener)
+	if serverErr != http.ErrServerClosed {
+		log.Fatal(serverErr)
+	}
+	<-shutdownDone
+}
+
+// loadConfigEnv overrides the fields of cfg with the VSE_* environment
+// variables named after them, e.g. VSE_PORT or VSE_OUTPUT_DIR. The values
+// are JSON, except that strings (and durations) may be left unquoted.
+func loadConfigEnv(cfg *JSONConfig) error {
+	fields := reflect.ValueOf(cfg).Elem()
+	for ii := 0; ii < fields.NumField(); ii++ {
+		name := "VSE_" + envName(fields.Type().Field(ii).Name)
+		value, found := os.LookupEnv(name)
+		if found == false {
+			continue
+		}
+		field := fields.Field(ii).Addr().Interface()
+		unmarshalErr := json.Unmarshal([]byte(value), field)
+		if unmarshalErr != nil {
+			quoted, _ := json.Marshal(value)
+			unmarshalErr = json.Unmarshal(quoted, field)
+		}
+		if unmarshalErr != nil {
+			return fmt.Errorf("Invalid %s", name)
+		}
+	}
+	return nil
+}
+
+// envName turns a config field name into its environment variable
+// suffix: OutputDir becomes OUTPUT_DIR and MaxFPS MAX_FPS.
+func envName(field string) string {
+	var name []rune
+	runes := []rune(field)
+	for ii, char := range runes {
+		if ii > 0 && unicode.IsUpper(char) {
+			prev := runes[ii-1]
+			// A lone capital following an acronym starts a new word, as
+			// in HTTPServer, but FFmpeg stays in one piece.
+			acronymEnd := ii >= 2 && unicode.IsUpper(prev) && unicode.IsUpper(runes[ii-2]) &&
+				ii+1 < len(runes) && unicode.IsLower(runes[ii+1])
+			if unicode.IsUpper(prev) == false || acronymEnd {
+				name = append(name, '_')
+			}
+		}
+		name = append(name, unicode.ToUpper(char))
+	}
+	return string(name)
+}
+
+func handleTranscodeRequest(rw http.ResponseWriter, req *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if ok != true {
+		httpError(rw, req, http.StatusBadRequest, "Invalid Flusher")
+		return
+	}
+	treq, status, msg := parseTranscodeRequest(req, req.URL.Path)
+	if treq == nil {
+		httpError(rw, req, status, msg)
+		return
+	}
+	if req.Method == http.MethodOptions {
+		rw.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		// Anything else would start a transcode just the same.
+		rw.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	widthStats := stats.counters(treq.opts.Width)
+	for _, counters := range widthStats {
+		atomic.AddInt64(&counters.requests, 1)
+	}
+	rw = &countingWriter{ResponseWriter: rw, counters: widthStats}
+	if req.Header.Get("Sec-CH-Viewport-Width") != "" {
+		rw.Header().Add("Vary", "Sec-CH-Viewport-Width")
+	}
+	if config.RespectSaveData {
+		rw.Header().Add("Vary", "Save-Data")
+	}
+	if treq.capped {
+		rw.Header().Set("X-Effective-Width", strconv.Itoa(treq.opts.Width))
+	}
+	if treq.defaultWidth || treq.capped {
+		location := config.PathPrefix + treq.canonicalPath()
+		if req.URL.RawQuery != "" {
+			location += "?" + req.URL.RawQuery
+		}
+		rw.Header().Set("Content-Location", location)
+	}
+	if treq.clampedFrom != "" {
+		rw.Header().Set("X-Bitrate-Clamped", treq.clampedFrom+" -> "+treq.opts.Bitrate)
+	}
+	trFileName := treq.cacheFile()
+	origFile := openSource(rw, req, treq.filename)
+	if origFile == nil {
+		return
+	}
+	defer origFile.Close()
+	// The output is MP4 whatever the source's extension, which is also
+	// the cached file's.
+	rw.Header().Set("Content-Type", "video/mp4")
+	if req.URL.Query().Get("download") != "" {
+		downloadName := sanitizeDownloadName(req.URL.Query().Get("download"))
+		if downloadName == "" {
+			httpError(rw, req, http.StatusBadRequest, "Invalid download")
+			return
+		}
+		rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": downloadName}))
+	}
+	var deadline time.Time
+	if config.AllowTranscodeDeadline && req.Header.Get("X-Transcode-Deadline") != "" {
+		var deadlineOk bool
+		deadline, deadlineOk = parseDeadline(req.Header.Get("X-Transcode-Deadline"), time.Now())
+		if deadlineOk == false {
+			httpError(rw, req, http.StatusBadRequest, "Invalid X-Transcode-Deadline")
+			return
+		}
+	}
+	cachedName := treq.cachedFile()
+	if cachedName != "" {
+		stats.cacheHit(widthStats)
+		serveCached(rw, req, cachedName)
+		return
+	}
+	stillName := trFileName + ".jpg"
+	if config.StillImages {
+		_, stillErr := statCached(stillName)
+		if stillErr == nil {
+			stats.cacheHit(widthStats)
+			rw.Header().Set("Content-Type", "image/jpeg")
+			serveCached(rw, req, stillName)
+			return
+		}
+	}
+	if config.DegradeToAudio {
+		degradedName := treq.degraded().cachedFile()
+		if degradedName != "" {
+			stats.cacheHit(widthStats)
+			rw.Header().Set("X-Degraded", "audio-only")
+			serveCached(rw, req, degradedName)
+			return
+		}
+	}
+	if hasCacheDirective(req, "only-if-cached") {
+		// Proxies asking for this don't want to wait for a transcode.
+		httpError(rw, req, http.StatusGatewayTimeout, "Not Cached")
+		return
+	}
+	if req.Method == http.MethodHead {
+		// Don't start a transcode just to answer a HEAD.
+		if config.HeadUncached == "notfound" {
+			httpError(rw, req, http.StatusNotFound, "Not Cached")
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+	primed, _ := req.Context().Value(primeKey{}).(*transcodeJob)
+	if primed == nil && treq.attach == false && jobs.active(trFileName) {
+		// Pollers would rather come back once the file is cached than
+		// sit through a transcode of their own.
+		rw.Header().Set("Retry-After", "5")
+		httpError(rw, req, http.StatusTooEarly, "Transcode in progress")
+		return
+	}
+	if config.TailInProgress && req.ProtoAtLeast(1, 1) {
+		source := growing.get(trFileName)
+		if source != nil && serveGrowing(rw, req, flusher, source) {
+			stats.cacheHit(widthStats)
+			return
+		}
+	}
+	opts := treq.opts
+	opts.LogName = ffmpegLogName(req.Header.Get("X-Request-Id"))
+	still := false
+	mediaDuration := 0.0
+	// Without an extension to go by, ffprobe tells whether the source is
+	// something ffmpeg can read at all.
+	extensionless := path.Ext(treq.filename) == ""
+	if extensionless || opts.FPS > 0 || opts.MultiAudio || opts.VideoTrack > 0 || opts.BurnSubtitles || opts.ToneMap || config.AudioVisualization != "" || config.KeepRotation ||
+		(config.AutoConstantFrameRate && opts.CFR == 0) || config.ShortClips || config.StillImages || config.TranscodeTimeoutRatio > 0 ||
+		config.ColorPrimaries == "source" || config.ColorTransfer == "source" || config.ColorSpace == "source" {
+		probe, probeErr := probeFile(req.Context(), origFile.Name())
+		if probeErr != nil && extensionless && errors.Is(probeErr, errEncoderUnavailable) == false && req.Context().Err() == nil {
+			log.Printf("Unrecognized format of %s: %s", origFile.Name(), probeErr)
+			httpError(rw, req, http.StatusUnsupportedMediaType, "Unrecognized input format")
+			return
+		}
+		if probeErr != nil {
+			log.Printf("Could not probe %s: %s", origFile.Name(), probeErr)
+			opts.FPS = 0
+			opts.MultiAudio = false
+			// Burning in a track that may not exist would only fail.
+			opts.BurnSubtitles = false
+			// Tone mapping an SDR source would wash it out.
+			opts.ToneMap = false
+		} else {
+			if probe.videoStream() == nil && probe.audioChannels() > 0 {
+				opts.Visualization = config.AudioVisualization
+			}
+			if config.KeepRotation && probe.videoStream() != nil {
+				opts.Sideways = probe.videoStream().rotation()%180 != 0
+			}
+			// Only HDR sources need tone mapping.
+			if probe.videoStream() == nil || probe.videoStream().hdr() == false {
+				opts.ToneMap = false
+			}
+			if probe.videoStream() != nil {
+				opts.copyColorTags(*probe.videoStream())
+			}
+			if opts.VideoTrack > 0 && opts.VideoTrack >= probe.videoStreams() {
+				httpError(rw, req, http.StatusBadRequest, "Invalid vtrack")
+				return
+			}
+			if opts.BurnSubtitles {
+				subtitles := probe.subtitleStreams()
+				if opts.SubtitleTrack >= len(subtitles) {
+					httpError(rw, req, http.StatusBadRequest, "Invalid burnsub")
+					return
+				}
+				if stringInSlice(subtitles[opts.SubtitleTrack].CodecName, imageSubtitleCodecs) {
+					httpError(rw, req, http.StatusBadRequest, "Image subtitles can't be burned in")
+					return
+				}
+			}
+			// Only cap the frame rate, never raise it above the source's,
+			// unless it is being interpolated.
+			if opts.Interpolate == false && probe.frameRate() <= float64(opts.FPS) {
+				opts.FPS = 0
+			}
+			if config.AutoConstantFrameRate && opts.CFR == 0 && probe.variableFrameRate() {
+				opts.CFR = int(math.Round(probe.frameRate()))
+				if opts.FPS > 0 && opts.FPS < opts.CFR {
+					opts.CFR = opts.FPS
+				}
+			}
+			// There's nothing to downmix for sources that are stereo
+			// already.
+			if probe.audioChannels() <= 2 {
+				opts.MultiAudio = false
+			}
+			// Nor anything to normalise in silent ones, which GIFs
+			// turned into MP4s usually are.
+			if probe.audioChannels() == 0 {
+				opts.Loudnorm = false
+			}
+			mediaDuration = probe.duration()
+			if probe.videoStream() != nil {
+				still = config.StillImages && probe.singleFrame()
+				opts.ShortClip = config.ShortClips && probe.duration() > 0 && probe.duration() < shortClipDuration
+			}
+		}
+	}
+	if still {
+		serveStill(rw, req, origFile.Name(), opts, stillName)
+		return
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	// timedOut is set once the transcode has run out of time, as opposed
+	// to being cancelled.
+	var timedOut int32
+	if deadline.IsZero() == false {
+		// The client's deadline covers the wait for a slot too.
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			httpError(rw, req, http.StatusGatewayTimeout, "Transcode timed out")
+			return
+		}
+		timer := time.AfterFunc(remaining, func() {
+			log.Printf("Transcoding %s missed its X-Transcode-Deadline, aborting", origFile.Name())
+			atomic.StoreInt32(&timedOut, 1)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+	job := primed
+	if job == nil {
+		job = jobs.add(trFileName, treq, req, cancel)
+		defer jobs.remove(job)
+	}
+	cached, queueErr := acquireOutput(ctx, trFileName, treq.filename, func() bool {
+		cachedName = treq.cachedFile()
+		return cachedName != ""
+	})
+	if queueErr != nil {
+		if queueErr == errQueueFull {
+			rw.Header().Set("Retry-After", "5")
+			httpError(rw, req, http.StatusServiceUnavailable, "Too many requests queued")
+		} else if jobs.cancelled(job) {
+			httpError(rw, req, http.StatusConflict, "Transcode cancelled")
+		} else if atomic.LoadInt32(&timedOut) == 1 {
+			httpError(rw, req, http.StatusGatewayTimeout, "Transcode timed out")
+		}
+		return
+	}
+	if cached {
+		stats.cacheHit(widthStats)
+		serveCached(rw, req, cachedName)
+		return
+	}
+	defer queue.release(trFileName, treq.filename)
+	jobs.start(job)
+	// Another request may have finished this file while we were waiting
+	// for a slot.
+	cachedName = treq.cachedFile()
+	if cachedName != "" {
+		stats.cacheHit(widthStats)
+		serveCached(rw, req, cachedName)
+		return
+	}
+	for _, counters := range widthStats {
+		atomic.AddInt64(&counters.cacheMisses, 1)
+	}
+	// The directory is only created now, to keep cache hits down to a
+	// stat.
+	outputDir := path.Dir(trFileName)
+	dirErr := os.MkdirAll(outputDir, os.ModePerm)
+	if dirErr != nil {
+		httpError(rw, req, http.StatusBadRequest, "Could not create temporary directory")
+		return
+	}
+	// Low-latency outputs are tuned for watching live and aren't cached.
+	cacheable := treq.opts.LowLatency == false
+	tempName := ""
+	if cacheable && hasFreeSpace(cacheRoot(treq.opts.Width)) {
+		tempFile, tempFileErr := ioutil.TempFile(
+			outputDir,
+			path.Base(origFile.Name()))
+		if tempFileErr != nil {
+			httpError(rw, req, http.StatusBadRequest, "Could not create temporary file")
+			return
+		}
+		tempFile.Close()
+		tempName = tempFile.Name()
+	} else if cacheable && config.LowDiskMode == "reject" {
+		httpError(rw, req, http.StatusInsufficientStorage, "Insufficient Storage")
+		return
+	}
+	timeout := transcodeTimeout(mediaDuration)
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			log.Printf("Transcoding %s took longer than %s, aborting", origFile.Name(), timeout)
+			atomic.StoreInt32(&timedOut, 1)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+	transcodeStart := time.Now()
+	webhookStatus := "failed"
+	defer func() {
+		if webhookStatus == "failed" && ctx.Err() != nil && atomic.LoadInt32(&timedOut) == 0 {
+			webhookStatus = "cancelled"
+		}
+		if webhookStatus == "completed" {
+			stats.transcoded(widthStats, time.Since(transcodeStart), atomic.LoadInt64(&job.bytes))
+		}
+		notifyWebhook(treq, webhookStatus, time.Since(transcodeStart), trFileName)
+	}()
+	if treq.opts.TwoPass {
+		if tempName == "" {
+			httpError(rw, req, http.StatusInsufficientStorage, "Insufficient Storage")
+			return
+		}
+		// The two-pass output can only be served once it is complete.
+		encodeErr := encodeTwoPass(ctx, origFile.Name(), opts, tempName)
+		if encodeErr != nil {
+			os.Remove(tempName)
+			if jobs.cancelled(job) {
+				httpError(rw, req, http.StatusConflict, "Transcode cancelled")
+			} else if errors.Is(encodeErr, errEncoderUnavailable) {
+				httpError(rw, req, http.StatusServiceUnavailable, "Encoder unavailable")
+			} else if atomic.LoadInt32(&timedOut) == 1 {
+				httpError(rw, req, http.StatusGatewayTimeout, "Transcode timed out")
+			} else if ctx.Err() == nil {
+				log.Printf("Two-pass encode of %s failed: %s", origFile.Name(), encodeErr)
+				serveError(rw, req, http.StatusInternalServerError, "Transcoding failed")
+			}
+			return
+		}
+		os.Rename(tempName, trFileName)
+		cacheAdded(1)
+		info, statErr := os.Stat(trFileName)
+		if statErr == nil {
+			atomic.StoreInt64(&job.bytes, info.Size())
+		}
+		webhookStatus = "completed"
+		serveCached(rw, req, trFileName)
+		return
+	}
+	// HTTP/1.0 clients can't take a chunked response. Transcode into the
+	// cache first and serve them the file with a Content-Length, or when
+	// it can't be cached, send the stream and close the connection.
+	buffered := req.ProtoAtLeast(1, 1) == false && tempName != ""
+	if req.ProtoAtLeast(1, 1) {
+		rw.Header().Set("Transfer-Encoding", "chunked")
+	}
+	if buffered == false {
+		// The stream can't be seeked into until it is cached, tell the
+		// player so rather than leave it guessing.
+		rw.Header().Set("Accept-Ranges", "none")
+	}
+	completed := false
+	if config.TailInProgress && tempName != "" {
+		// Registered ahead of the ffmpeg cleanup so that it only reports
+		// the file as done once ffmpeg has exited.
+		source := growing.add(trFileName, tempName)
+		defer func() {
+			growing.finish(trFileName, source, completed)
+		}()
+	}
+	opts.Hardware = config.HardwareEncoder != ""
+	tret := transcodeWithFallbacks(ctx, origFile.Name(), opts, tempName)
+	cmd := tret.cmd
+	if cmd.Process == nil {
+		if tempName != "" {
+			os.Remove(tempName)
+		}
+		if errors.Is(tret.err, errEncoderUnavailable) {
+			httpError(rw, req, http.StatusServiceUnavailable, "Encoder unavailable")
+			return
+		}
+		serveError(rw, req, http.StatusInternalServerError, "Transcoding failed")
+		return
+	}
+	outputName := trFileName
+	if tret.degraded {
+		// Cached apart, so that it isn't served as the full rendition.
+		outputName = treq.degraded().cacheFile()
+		rw.Header().Set("X-Degraded", "audio-only")
+	}
+	defer cmd.Process.Kill()
+	defer cmd.Process.Wait()
+	rc := *(tret.rc)
+	defer rc.Close()
+	started := make(chan struct{})
+	if config.StartupWarning.Duration > 0 || config.StartupTimeout.Duration > 0 {
+		go watchStartup(ctx, cancel, origFile.Name(), started)
+	}
+	var dst io.Writer = rw
+	if buffered {
+		dst = ioutil.Discard
+	} else {
+		// Send the headers straight away so that proxies don't give up
+		// on an idle response while ffmpeg gets going.
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		coalescer := newFlushCoalescer(rw, flusher, config.FlushInterval.Duration)
+		defer coalescer.Close()
+		dst = coalescer
+	}
+	done := 0
+	for {
+		written, err := io.CopyN(dst, rc, 16*1024)
+		atomic.AddInt64(&job.bytes, written)
+		if written > 0 && started != nil {
+			close(started)
+			started = nil
+		}
+		if err != nil {
+			done = 1
+			// A cancelled or failed ffmpeg also ends its output with
+			// EOF, only a transcode that ran to completion goes into the
+			// cache.
+			if err == io.EOF && ctx.Err() == nil && tret.succeeded() {
+				if tempName != "" {
+					os.Rename(tempName, outputName)
+					cacheAdded(1)
+				}
+				completed = true
+				webhookStatus = "completed"
+				break
+			}
+			if err != io.EOF {
+				logCopyErr(req, err)
+			}
+			if tempName != "" {
+				os.Remove(tempName)
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			done = 1
+			break
+		default:
+			break
+		}
+		if done == 1 {
+			if tempName != "" {
+				os.Remove(tempName)
+			}
+			break
+		}
+	}
+	if buffered {
+		if completed {
+			serveCached(rw, req, outputName)
+		} else if jobs.cancelled(job) {
+			httpError(rw, req, http.StatusConflict, "Transcode cancelled")
+		} else if atomic.LoadInt32(&timedOut) == 1 {
+			httpError(rw, req, http.StatusGatewayTimeout, "Transcode timed out")
+		} else if ctx.Err() == nil {
+			serveError(rw, req, http.StatusInternalServerError, "Transcoding failed")
+		}
+	}
+}
+
+// serveStill serves the single frame of inputFile as a JPEG, generating
+// it into stillName first unless another request already has.
+func serveStill(rw http.ResponseWriter, req *http.Request, inputFile string, opts TranscodeOptions, stillName string) {
+	ctx := req.Context()
+	cached, queueErr := acquireOutput(ctx, stillName, path.Base(inputFile), func() bool {
+		_, statErr := statCached(stillName)
+		return statErr == nil
+	})
+	if queueErr == errQueueFull {
+		rw.Header().Set("Retry-After", "5")
+		httpError(rw, req, http.StatusServiceUnavailable, "Too many requests queued")
+		return
+	}
+	if queueErr != nil {
+		return
+	}
+	if cached == false {
+		defer queue.release(stillName, path.Base(inputFile))
+	}
+	_, stillErr := statCached(stillName)
+	if stillErr != nil {
+		generateErr := generateStill(ctx, inputFile, opts, stillName)
+		if generateErr != nil {
+			if errors.Is(generateErr, errEncoderUnavailable) {
+				httpError(rw, req, http.StatusServiceUnavailable, "Encoder unavailable")
+			} else if ctx.Err() == nil {
+				log.Printf("Still image of %s failed: %s", inputFile, generateErr)
+				serveError(rw, req, http.StatusInternalServerError, "Transcoding failed")
+			}
+			return
+		}
+		cacheAdded(1)
+	}
+	rw.Header().Set("Content-Type", "image/jpeg")
+	serveCached(rw, req, stillName)
+}
+
+// flushThreshold is the most a flushCoalescer holds back before flushing.
+const flushThreshold = 256 * 1024
+
+// flushCoalescer writes to a streamed response, flushing at most every
+// interval or flushThreshold bytes so that high bitrate streams don't
+// turn into a syscall per read. A ticker flushes whatever is pending in
+// between, keeping the latency bounded when ffmpeg stalls. With a zero
+// interval every write is flushed.
+type flushCoalescer struct {
+	mu       sync.Mutex
+	rw       io.Writer
+	flusher  http.Flusher
+	interval time.Duration
+	pending  int
+	done     chan struct{}
+}
+
+func newFlushCoalescer(rw io.Writer, flusher http.Flusher, interval time.Duration) *flushCoalescer {
+	coalescer := &flushCoalescer{rw: rw, flusher: flusher, interval: interval, done: make(chan struct{})}
+	if interval > 0 {
+		go coalescer.tick()
+	}
+	return coalescer
+}
+
+func (fc *flushCoalescer) Write(p []byte) (int, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	n, err := fc.rw.Write(p)
+	fc.pending += n
+	if fc.interval <= 0 || fc.pending >= flushThreshold {
+		fc.flushLocked()
+	}
+	return n, err
+}
+
+func (fc *flushCoalescer) tick() {
+	ticker := time.NewTicker(fc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fc.mu.Lock()
+			fc.flushLocked()
+			fc.mu.Unlock()
+		case <-fc.done:
+			return
+		}
+	}
+}
+
+func (fc *flushCoalescer) flushLocked() {
+	if fc.pending > 0 {
+		fc.flusher.Flush()
+		fc.pending = 0
+	}
+}
+
+// Close stops the ticker and flushes what is left. The response must not
+// be used by the coalescer once the handler has returned.
+func (fc *flushCoalescer) Close() error {
+	close(fc.done)
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.flushLocked()
+	return nil
+}
+
+// serveGrowing streams source, a cache file still being transcoded, to a
+// client joining late. It returns false when the file has already gone,
+// having been renamed into the cache or removed, and nothing was sent.
+func serveGrowing(rw http.ResponseWriter, req *http.Request, flusher http.Flusher, source *growingFile) bool {
+	file, openErr := os.Open(source.name)
+	if openErr != nil {
+		return false
+	}
+	defer file.Close()
+	rw.Header().Set("Transfer-Encoding", "chunked")
+	rw.Header().Set("Accept-Ranges", "none")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	reader := &TailingReader{file: file, source: source, ctx: req.Context()}
+	coalescer := newFlushCoalescer(rw, flusher, config.FlushInterval.Duration)
+	defer coalescer.Close()
+	for {
+		_, copyErr := io.CopyN(coalescer, reader, 16*1024)
+		if copyErr == io.EOF {
+			return true
+		}
+		if copyErr != nil {
+			if copyErr == errTranscodeFailed {
+				log.Printf("Transcode of %s failed while tailing it", source.name)
+				// The response has started, dropping the connection is
+				// the only way left to tell the client it is incomplete.
+				panic(http.ErrAbortHandler)
+			}
+			logCopyErr(req, copyErr)
+			return true
+		}
+	}
+}
+
+// logCopyErr logs an error streaming a response. Clients closing the
+// connection part way through (seeking, closing the tab) is routine, so that
+// only shows up with Debug.
+func logCopyErr(req *http.Request, err error) {
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, context.Canceled) || req.Context().Err() != nil {
+		debugf("Client went away from %s: %s", req.URL.Path, err)
+		return
+	}
+	log.Printf("Error writing to client for %s: %s", req.URL.Path, err)
+}
+
+// debugf logs only when Debug is set in the config.
+func debugf(format string, v ...interface{}) {
+	if config.Debug {
+		log.Printf(format, v...)
+	}
+}
+
+// transcodeTimeout is how long a transcode of a source lasting duration
+// seconds may run, the stricter of TranscodeTimeout and the limit from
+// TranscodeTimeoutRatio, or zero for no limit. Sources of unknown length
+// get TranscodeTimeoutMax.
+func transcodeTimeout(duration float64) time.Duration {
+	timeout := config.TranscodeTimeout.Duration
+	if config.TranscodeTimeoutRatio > 0 {
+		scaled := config.TranscodeTimeoutMax.Duration
+		if duration > 0 {
+			scaled = time.Duration(duration * config.TranscodeTimeoutRatio * float64(time.Second))
+			if scaled < config.TranscodeTimeoutMin.Duration {
+				scaled = config.TranscodeTimeoutMin.Duration
+			}
+			if config.TranscodeTimeoutMax.Duration > 0 && scaled > config.TranscodeTimeoutMax.Duration {
+				scaled = config.TranscodeTimeoutMax.Duration
+			}
+		}
+		if scaled > 0 && (timeout == 0 || scaled < timeout) {
+			timeout = scaled
+		}
+	}
+	return timeout
+}
+
+// parseDeadline reads an X-Transcode-Deadline, an RFC 3339 time or a
+// positive duration from now. It reports false for anything else.
+func parseDeadline(value string, now time.Time) (time.Time, bool) {
+	deadline, timeErr := time.Parse(time.RFC3339, value)
+	if timeErr == nil {
+		return deadline, true
+	}
+	duration, durationErr := time.ParseDuration(value)
+	if durationErr != nil || duration <= 0 {
+		return time.Time{}, false
+	}
+	return now.Add(duration), true
+}
+
+// watchStartup logs a warning when a transcode hasn't produced any output
+// after StartupWarning and cancels it after StartupTimeout. Nothing is
+// sent to the client meanwhile: an empty chunk would end the chunked
+// response and filler bytes would corrupt the video.
+func watchStartup(ctx context.Context, cancel context.CancelFunc, inputFile string, started chan struct{}) {
+	start := time.Now()
+	if config.StartupWarning.Duration > 0 {
+		timer := time.NewTimer(config.StartupWarning.Duration)
+		defer timer.Stop()
+		select {
+		case <-started:
+			return
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			log.Printf("No output transcoding %s after %s", inputFile, config.StartupWarning.Duration)
+		}
+	}
+	if config.StartupTimeout.Duration > 0 {
+		timer := time.NewTimer(config.StartupTimeout.Duration - time.Since(start))
+		defer timer.Stop()
+		select {
+		case <-started:
+			return
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			log.Printf("No output transcoding %s after %s, aborting", inputFile, config.StartupTimeout.Duration)
+			cancel()
+		}
+	}
+}
+
+// serveCached serves a cached file with an ETag derived from its size and
+// modification time, so that clients can revalidate it. http.ServeFile
+// sends it with sendfile as long as every ResponseWriter wrapper passes
+// ReadFrom through, as countingWriter and recoveryWriter do. The
+// throttledWriter doesn't, it has to pace every write.
+func serveCached(rw http.ResponseWriter, req *http.Request, name string) {
+	info, statErr := os.Stat(name)
+	if statErr == nil {
+		rw.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano()))
+		data := memCache.get(name, info)
+		if data == nil && info.Size() <= memCacheMaxFile && info.Size() <= config.MemCacheBytes {
+			data = memCache.load(name, info)
+		}
+		if data != nil {
+			http.ServeContent(rw, req, name, info.ModTime(), bytes.NewReader(data))
+			return
+		}
+	}
+	http.ServeFile(rw, req, name)
+}
+
+// memCacheMaxFile is the largest file kept in the memCache.
+const memCacheMaxFile = 1024 * 1024
+
+// memoryCache is a least recently used cache of file contents, holding up
+// to limit bytes. Entries are only served while the file's size and
+// modification time are unchanged, so that files replaced or removed on
+// disk drop out.
+type memoryCache struct {
+	mu      sync.Mutex
+	limit   int64
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func newMemoryCache(limit int64) *memoryCache {
+	return &memoryCache{limit: limit, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the contents of name if they are cached and still match
+// info, or nil.
+func (c *memoryCache) get(name string, info os.FileInfo) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[name]
+	if found == false {
+		return nil
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if int64(len(entry.data)) != info.Size() || entry.modTime.Equal(info.ModTime()) == false {
+		c.remove(elem)
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return entry.data
+}
+
+// load reads name into the cache, evicting the least recently used
+// entries to make room. It returns nil if the file changed from info in
+// the meantime or can't be read.
+func (c *memoryCache) load(name string, info os.FileInfo) []byte {
+	data, readErr := ioutil.ReadFile(name)
+	if readErr != nil || int64(len(data)) != info.Size() {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[name]
+	if found {
+		c.remove(elem)
+	}
+	c.entries[name] = c.order.PushFront(&memoryCacheEntry{name, data, info.ModTime()})
+	c.size += int64(len(data))
+	for c.size > c.limit {
+		c.remove(c.order.Back())
+	}
+	return data
+}
+
+func (c *memoryCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*memoryCacheEntry)
+	delete(c.entries, entry.name)
+	c.size -= int64(len(entry.data))
+}
+
+// hasFreeSpace reports whether the volume holding dir has at least
+// MinFreeBytes available, evicting the oldest cached transcodes in dir to
+// make room if it doesn't.
+func hasFreeSpace(dir string) bool {
+	if config.MinFreeBytes <= 0 {
+		return true
+	}
+	free, freeErr := freeBytes(dir)
+	if freeErr == errFreeBytesUnknown {
+		return true
+	}
+	if freeErr != nil {
+		log.Printf("Could not stat %s: %s", dir, freeErr)
+		return true
+	}
+	if free >= config.MinFreeBytes {
+		return true
+	}
+	log.Printf("Disk pressure on %s: %d bytes free, want %d", dir, free, config.MinFreeBytes)
+	evicted, _ := evictCache(dir, config.MinFreeBytes-free, 0)
+	free, freeErr = freeBytes(dir)
+	if freeErr != nil || free < config.MinFreeBytes {
+		log.Printf("Disk pressure on %s persists after evicting %d bytes", dir, evicted)
+		return false
+	}
+	log.Printf("Evicted %d bytes from %s", evicted, dir)
+	return true
+}
+
+// errFreeBytesUnknown is returned by freeBytes where the free space
+// can't be told, see freebytes_other.go.
+var errFreeBytesUnknown = errors.New("free space unknown")
+
+// cacheAdded records n new files in the cache and, when there are more
+// than MaxCacheFiles, wakes evictExcessFiles to evict the oldest ones.
+// It doesn't wait for the cache to be walked, and a wakeup still pending
+// covers these files too.
+func cacheAdded(n int64) {
+	if config.MaxCacheFiles <= 0 {
+		return
+	}
+	if atomic.AddInt64(&cacheFiles, n) <= config.MaxCacheFiles {
+		return
+	}
+	select {
+	case evictions <- struct{}{}:
+	default:
+	}
+}
+
+// evictExcessFiles evicts the oldest files whenever cacheAdded finds
+// more than MaxCacheFiles. It evicts a tenth of the cap on top of the
+// excess, so that the cache isn't walked again for every new file.
+func evictExcessFiles() {
+	for range evictions {
+		over := atomic.LoadInt64(&cacheFiles) - config.MaxCacheFiles
+		if over <= 0 {
+			continue
+		}
+		_, removed := evictCache("", 0, over+config.MaxCacheFiles/10)
+		if removed > 0 {
+			log.Printf("Evicted %d files from the cache", removed)
+		}
+	}
+}
+
+// cacheExpired reports whether the cached file info is older than the
+// CacheTTL.
+func cacheExpired(info os.FileInfo) bool {
+	return config.CacheTTL.Duration > 0 && time.Since(info.ModTime()) > config.CacheTTL.Duration
+}
+
+// statCached is os.Stat for the cached file name, which is removed and
+// reported missing once it is older than the CacheTTL.
+func statCached(name string) (os.FileInfo, error) {
+	info, statErr := os.Stat(name)
+	if statErr == nil && cacheExpired(info) {
+		if os.Remove(name) == nil {
+			atomic.AddInt64(&cacheFiles, -1)
+		}
+		return nil, os.ErrNotExist
+	}
+	return info, statErr
+}
+
+// expireCache removes the cached files older than the CacheTTL, those
+// that aren't requested again included, checking every hour or every
+// CacheTTL if that is shorter.
+func expireCache() {
+	interval := time.Hour
+	if config.CacheTTL.Duration < interval {
+		interval = config.CacheTTL.Duration
+	}
+	for {
+		var removed int64
+		for _, cacheDir := range cacheDirs() {
+			filepath.Walk(cacheDir, func(name string, info os.FileInfo, err error) error {
+				if err != nil || info.Mode().IsRegular() == false || cacheExpired(info) == false {
+					return nil
+				}
+				if os.Remove(name) == nil {
+					removed++
+				}
+				return nil
+			})
+		}
+		if removed > 0 {
+			atomic.AddInt64(&cacheFiles, -removed)
+			log.Printf("Removed %d cached files older than %s", removed, config.CacheTTL.Duration)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// evictCache removes cached files under dir, or anywhere in the cache if
+// dir is empty, least recently written first, until wantBytes and
+// wantFiles have been freed. Files written in the last minute are left
+// alone as they are likely still being transcoded. It returns the number
+// of bytes and files removed.
+func evictCache(dir string, wantBytes int64, wantFiles int64) (int64, int64) {
+	evictMu.Lock()
+	defer evictMu.Unlock()
+	type cached struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cached
+	var total int64
+	cutoff := time.Now().Add(-time.Minute)
+	seen := make(map[string]bool)
+	for _, cacheDir := range cacheDirs() {
+		filepath.Walk(cacheDir, func(name string, info os.FileInfo, err error) error {
+			// Directories of OutputDirs may be nested in OutputDir.
+			if err != nil || info.Mode().IsRegular() == false || seen[name] {
+				return nil
+			}
+			seen[name] = true
+			total++
+			if info.ModTime().Before(cutoff) && (dir == "" || inDir(dir, name)) {
+				files = append(files, cached{name, info.Size(), info.ModTime()})
+			}
+			return nil
+		})
+	}
+	sort.Slice(files, func(ii, jj int) bool {
+		return files[ii].modTime.Before(files[jj].modTime)
+	})
+	var evicted, removed int64
+	for _, file := range files {
+		if evicted >= wantBytes && removed >= wantFiles {
+			break
+		}
+		if os.Remove(file.name) == nil {
+			evicted += file.size
+			removed++
+		}
+	}
+	atomic.StoreInt64(&cacheFiles, total-removed)
+	return evicted, removed
+}
+
+// purgeRemovedWidths removes the width directories of OutputDir, in every
+// namespace and partition, that aren't for one of the Widths. Those
+// holding an OutputDirs directory are left alone.
+func purgeRemovedWidths() {
+	widths := make(map[string]bool)
+	for _, width := range config.Widths {
+		widths[strconv.Itoa(width)] = true
+	}
+	roots := []string{config.OutputDir}
+	if len(config.Tenants) > 0 {
+		roots = []string{path.Join(config.OutputDir, "default")}
+		for _, tenant := range config.Tenants {
+			roots = append(roots, path.Join(config.OutputDir, tenant))
+		}
+	}
+	var dirs []string
+	for _, root := range roots {
+		dirs = append(dirs, root)
+		entries, _ := ioutil.ReadDir(root)
+		for _, entry := range entries {
+			if entry.IsDir() && partitionRegex.MatchString(entry.Name()) {
+				dirs = append(dirs, path.Join(root, entry.Name()))
+			}
+		}
+	}
+	for _, dir := range dirs {
+		entries, _ := ioutil.ReadDir(dir)
+		for _, entry := range entries {
+			width, atoiErr := strconv.Atoi(entry.Name())
+			if entry.IsDir() == false || atoiErr != nil || strconv.Itoa(width) != entry.Name() || widths[entry.Name()] {
+				continue
+			}
+			widthDir := path.Join(dir, entry.Name())
+			nested := false
+			for _, outputDir := range config.OutputDirs {
+				if inDir(resolveDir(widthDir), resolveDir(outputDir)) {
+					nested = true
+				}
+			}
+			if nested {
+				continue
+			}
+			files := 0
+			filepath.Walk(widthDir, func(name string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					files++
+				}
+				return nil
+			})
+			removeErr := os.RemoveAll(widthDir)
+			if removeErr != nil {
+				log.Printf("Could not purge %s of removed width %d: %s", widthDir, width, removeErr)
+				continue
+			}
+			log.Printf("Purged %s of removed width %d (%d files)", widthDir, width, files)
+		}
+	}
+}
+
+// cacheRoot returns the directory holding the renditions of width: its
+// OutputDirs entry, or OutputDir.
+func cacheRoot(width int) string {
+	if dir, ok := config.OutputDirs[width]; ok {
+		return dir
+	}
+	return config.OutputDir
+}
+
+// cacheDirs returns OutputDir and the OutputDirs directories.
+func cacheDirs() []string {
+	dirs := []string{config.OutputDir}
+	for _, dir := range config.OutputDirs {
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// checkOverlap returns an error for a cache directory that is, holds or
+// lies under the InputDir. Outputs cached among the sources would be
+// served, watched and transcoded as sources in turn.
+func checkOverlap() error {
+	inputDir := resolveDir(config.InputDir)
+	for _, dir := range cacheDirs() {
+		outputDir := resolveDir(dir)
+		if inDir(inputDir, outputDir) || inDir(outputDir, inputDir) {
+			return fmt.Errorf("Output directory %s overlaps InputDir %s", dir, config.InputDir)
+		}
+	}
+	return nil
+}
+
+// inDir reports whether name is dir or lies under it.
+func inDir(dir string, name string) bool {
+	rel, relErr := filepath.Rel(dir, name)
+	return relErr == nil && rel != ".." && strings.HasPrefix(rel, "../") == false
+}
+
+// resolveDir returns dir as an absolute path with the symlinks of its
+// existing part resolved, so that directories yet to be created compare
+// right too.
+func resolveDir(dir string) string {
+	absDir, absErr := filepath.Abs(dir)
+	if absErr != nil {
+		return dir
+	}
+	missing := ""
+	for {
+		resolved, resolveErr := filepath.EvalSymlinks(absDir)
+		if resolveErr == nil {
+			return filepath.Join(resolved, missing)
+		}
+		parent := filepath.Dir(absDir)
+		if parent == absDir {
+			return filepath.Join(absDir, missing)
+		}
+		missing = filepath.Join(filepath.Base(absDir), missing)
+		absDir = parent
+	}
+}
+
+// sourceState is what watchInputDir compares to notice a changed source.
+type sourceState struct {
+	size    int64
+	modTime time.Time
+}
+
+// inputDir is what scanInputDir found in a directory of InputDir.
+type inputDir struct {
+	modTime time.Time
+	// files are the files directly in the directory and subdirs its
+	// directories, by their names relative to InputDir.
+	files   map[string]sourceState
+	subdirs []string
+}
+
+// fullScanEvery is how many polls watchInputDir goes between full scans.
+// Those catch the files overwritten in place, which doesn't change the
+// modification time of their directory, and changes made within the
+// same tick of a coarse directory timestamp as the previous poll.
+const fullScanEvery = 10
+
+// watchInputDir purges the cached outputs of the source files that
+// changed or went away, checking InputDir every interval. It polls
+// rather than relying on inotify and the like, which would take a
+// dependency, and only lists the directories that changed.
+func watchInputDir(interval time.Duration) {
+	dirs := scanInputDir(nil)
+	known := inputFiles(dirs)
+	polls := 0
+	for range time.Tick(interval) {
+		polls++
+		previous := dirs
+		if polls%fullScanEvery == 0 {
+			previous = nil
+		}
+		dirs = scanInputDir(previous)
+		current := inputFiles(dirs)
+		for filename, state := range known {
+			now, ok := current[filename]
+			if ok && now == state {
+				continue
+			}
+			inFlight, _ := settleInFlight(context.Background(), filename, config.PurgeInFlight == "cancel")
+			removed := purgeSource(filename)
+			if removed > 0 || inFlight != "none" {
+				log.Printf("Purged %d cached files of %s, which changed (in-flight transcodes: %s)", removed, filename, inFlight)
+			}
+		}
+		known = current
+	}
+}
+
+// scanInputDir returns every directory in InputDir, by its name relative
+// to it ("." for InputDir itself). A directory whose modification time
+// is the same as in previous had no files added, removed or renamed, and
+// is taken from previous rather than listed again.
+func scanInputDir(previous map[string]*inputDir) map[string]*inputDir {
+	dirs := make(map[string]*inputDir)
+	scanInputSubdir(".", previous, dirs)
+	return dirs
+}
+
+// scanInputSubdir adds the directory rel and those under it to dirs.
+func scanInputSubdir(rel string, previous map[string]*inputDir, dirs map[string]*inputDir) {
+	name := filepath.Join(config.InputDir, filepath.FromSlash(rel))
+	info, statErr := os.Stat(name)
+	if statErr != nil || info.IsDir() == false {
+		return
+	}
+	dir, ok := previous[rel]
+	if ok == false || dir.modTime.Equal(info.ModTime()) == false {
+		infos, readErr := ioutil.ReadDir(name)
+		if readErr != nil {
+			return
+		}
+		dir = &inputDir{modTime: info.ModTime(), files: make(map[string]sourceState)}
+		for _, entry := range infos {
+			entryRel := path.Join(rel, entry.Name())
+			if entry.IsDir() {
+				dir.subdirs = append(dir.subdirs, entryRel)
+			} else if entry.Mode().IsRegular() {
+				dir.files[entryRel] = sourceState{entry.Size(), entry.ModTime()}
+			}
+		}
+	}
+	dirs[rel] = dir
+	for _, subdir := range dir.subdirs {
+		scanInputSubdir(subdir, previous, dirs)
+	}
+}
+
+// inputFiles returns the state of every file in dirs, by its name
+// relative to InputDir.
+func inputFiles(dirs map[string]*inputDir) map[string]sourceState {
+	sources := make(map[string]sourceState)
+	for _, dir := range dirs {
+		for filename, state := range dir.files {
+			sources[filename] = state
+		}
+	}
+	return sources
+}
+
+// cachedSuffixRegex matches what follows the source's name in the name of
+// its cached transcodes and stills (extensionlessSuffixRegex for sources
+// without an extension), previewSuffixRegex in that of its
+// previews, pipSuffixRegex in that of its picture-in-picture outputs and
+// spriteSuffixRegex in that of its sprites.
+var cachedSuffixRegex = regexp.MustCompile("^(\\.[0-9a-f]{16}\\.mp4)?(\\.jpg)?$")
+var extensionlessSuffixRegex = regexp.MustCompile("^(\\.[0-9a-f]{16})?\\.mp4(\\.jpg)?$")
+var previewSuffixRegex = regexp.MustCompile("^\\.[0-9.]+s-[0-9.]+s-[0-9]+w(-[A-Za-z0-9._-]+)?\\.(webp|mp4)$")
+var pipSuffixRegex = regexp.MustCompile("^\\.[0-9a-f]{16}\\.mp4$")
+var spriteSuffixRegex = regexp.MustCompile("^\\.[0-9]+x[0-9]+-[0-9]+s-[0-9]+w(-accurate)?(-[A-Za-z0-9._-]+)?\\.(jpg|vtt)$")
+
+// partitionRegex matches the directories of daily cache partitions.
+var partitionRegex = regexp.MustCompile("^[0-9]{4}-[0-9]{2}-[0-9]{2}$")
+
+// purgeSource removes every cached output of the source filename, at
+// every width, with any options, in every partition and namespace, and
+// returns how many files went.
+func purgeSource(filename string) int {
+	var removed int64
+	for _, root := range cacheDirs() {
+		widthDirs := root == config.OutputDir
+		filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+			if err != nil || info.Mode().IsRegular() == false {
+				return nil
+			}
+			rel, relErr := filepath.Rel(root, name)
+			if relErr != nil || cachedFrom(filepath.ToSlash(rel), filename, widthDirs) == false {
+				return nil
+			}
+			if os.Remove(name) == nil {
+				removed++
+			}
+			return nil
+		})
+	}
+	if config.MaxCacheFiles > 0 {
+		atomic.AddInt64(&cacheFiles, -removed)
+	}
+	return int(removed)
+}
+
+// cachedFrom reports whether rel, the path of a file relative to a cache
+// directory, is an output of the source filename. Under OutputDir the
+// outputs are in a directory per width, under those of OutputDirs they
+// aren't.
+func cachedFrom(rel string, filename string, widthDirs bool) bool {
+	if widthDirs && strings.HasPrefix(rel, "sprites/"+filename) {
+		return spriteSuffixRegex.MatchString(strings.TrimPrefix(rel, "sprites/"+filename))
+	}
+	if widthDirs && strings.HasPrefix(rel, "previews/"+filename) {
+		return previewSuffixRegex.MatchString(strings.TrimPrefix(rel, "previews/"+filename))
+	}
+	if widthDirs && strings.HasPrefix(rel, "pip/"+filename) {
+		return pipSuffixRegex.MatchString(strings.TrimPrefix(rel, "pip/"+filename))
+	}
+	segments := strings.Split(rel, "/")
+	depth := strings.Count(filename, "/") + 1
+	if len(segments) < depth {
+		return false
+	}
+	base := strings.Join(segments[len(segments)-depth:], "/")
+	suffixRegex := cachedSuffixRegex
+	if path.Ext(filename) == "" {
+		suffixRegex = extensionlessSuffixRegex
+	}
+	if strings.HasPrefix(base, filename) == false || suffixRegex.MatchString(base[len(filename):]) == false {
+		return false
+	}
+	dirs := segments[:len(segments)-depth]
+	if widthDirs {
+		if len(dirs) == 0 {
+			return false
+		}
+		_, widthErr := strconv.Atoi(dirs[len(dirs)-1])
+		if widthErr != nil {
+			return false
+		}
+		dirs = dirs[:len(dirs)-1]
+	}
+	if len(dirs) > 0 && partitionRegex.MatchString(dirs[len(dirs)-1]) {
+		dirs = dirs[:len(dirs)-1]
+	}
+	if len(dirs) > 0 && len(config.Tenants) > 0 && namespaceRegex.MatchString(dirs[len(dirs)-1]) {
+		dirs = dirs[:len(dirs)-1]
+	}
+	return len(dirs) == 0
+}
+
+// openSource opens filename in InputDir, checking it is a file that is
+// worth transcoding. On failure it writes the error response and returns
+// nil.
+func openSource(rw http.ResponseWriter, req *http.Request, filename string) *os.File {
+	source := currentSources().resolve(filename)
+	if source == "" {
+		serveError(rw, req, http.StatusNotFound, "Not Found")
+		return nil
+	}
+	if allowedExtension(source) == false {
+		httpError(rw, req, http.StatusUnsupportedMediaType, "Unsupported Media Type")
+		return nil
+	}
+	origFile, origInfo, origFileErr := openInput(fmt.Sprintf("%s/%s", config.InputDir, source))
+	if origFileErr == errFileOpTimeout {
+		log.Printf("Timed out opening %s in %s", source, config.InputDir)
+		httpError(rw, req, http.StatusGatewayTimeout, "Source storage timed out")
+		return nil
+	}
+	if origFileErr != nil {
+		serveError(rw, req, http.StatusNotFound, "Not Found")
+		return nil
+	}
+	if origInfo == nil || origInfo.IsDir() {
+		origFile.Close()
+		httpError(rw, req, http.StatusBadRequest, "Invalid Filename")
+		return nil
+	}
+	// Empty files are usually failed uploads, ffmpeg would only die on
+	// them with an opaque error.
+	if origInfo.Size() == 0 {
+		origFile.Close()
+		httpError(rw, req, http.StatusUnprocessableEntity, "Source file is empty")
+		return nil
+	}
+	if origInfo.Size() < config.MinInputBytes {
+		origFile.Close()
+		httpError(rw, req, http.StatusUnprocessableEntity, "Source file is too small")
+		return nil
+	}
+	return origFile
+}
+
+// errFileOpTimeout is returned by openInput when the file system doesn't
+// answer within the FileOpTimeout.
+var errFileOpTimeout = errors.New("file operation timed out")
+
+// openInput opens and stats name, giving up after the FileOpTimeout. The
+// open carries on in the background, as a syscall blocked on a stale
+// mount can't be interrupted, and a file it opens too late is closed. The
+// FileInfo is nil when only the stat failed.
+func openInput(name string) (*os.File, os.FileInfo, error) {
+	type opened struct {
+		file *os.File
+		info os.FileInfo
+		err  error
+	}
+	result := make(chan opened)
+	abandoned := make(chan struct{})
+	go func() {
+		var ret opened
+		ret.file, ret.err = os.Open(name)
+		if ret.err == nil {
+			ret.info, _ = ret.file.Stat()
+		}
+		select {
+		case result <- ret:
+		case <-abandoned:
+			if ret.file != nil {
+				ret.file.Close()
+			}
+		}
+	}()
+	if config.FileOpTimeout.Duration <= 0 {
+		ret := <-result
+		return ret.file, ret.info, ret.err
+	}
+	timer := time.NewTimer(config.FileOpTimeout.Duration)
+	defer timer.Stop()
+	select {
+	case ret := <-result:
+		return ret.file, ret.info, ret.err
+	case <-timer.C:
+		close(abandoned)
+		return nil, nil, errFileOpTimeout
+	}
+}
+
+// handleSpriteRequest serves /sprite/{filename}.jpg, a sheet of
+// thumbnails taken every interval seconds for scrubbing previews, and
+// /sprite/{filename}.vtt, the WebVTT track mapping times to the
+// thumbnails in the sheet. Both are generated together and cached in
+// OutputDir/sprites.
+func handleSpriteRequest(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/sprite/")
+	ext := path.Ext(name)
+	if ext != ".jpg" && ext != ".vtt" {
+		httpError(rw, req, http.StatusNotFound, "Not Found")
+		return
+	}
+	filename := cleanFilename(strings.TrimSuffix(name, ext))
+	if filename == "" {
+		httpError(rw, req, http.StatusBadRequest, "Invalid Filename")
+		return
+	}
+	sopts, msg := parseSpriteOptions(req.URL.Query())
+	if msg != "" {
+		httpError(rw, req, http.StatusBadRequest, msg)
+		return
+	}
+	origFile := openSource(rw, req, filename)
+	if origFile == nil {
+		return
+	}
+	defer origFile.Close()
+	spriteBase := fmt.Sprintf("%s.%dx%d-%ds-%dw",
+		path.Join(config.OutputDir, "sprites", filename),
+		sopts.Columns, sopts.Rows, sopts.Interval, sopts.Width)
+	if sopts.Accurate {
+		spriteBase += "-accurate"
+	}
+	if config.CacheVersion != "" {
+		spriteBase += "-" + config.CacheVersion
+	}
+	spriteFile := spriteBase + ext
+	_, spriteErr := statCached(spriteFile)
+	if spriteErr == nil {
+		serveCached(rw, req, spriteFile)
+		return
+	}
+	ctx := req.Context()
+	cached, queueErr := acquireOutput(ctx, spriteBase, filename, func() bool {
+		_, statErr := statCached(spriteFile)
+		return statErr == nil
+	})
+	if queueErr == errQueueFull {
+		rw.Header().Set("Retry-After", "5")
+		httpError(rw, req, http.StatusServiceUnavailable, "Too many requests queued")
+		return
+	}
+	if queueErr != nil {
+		return
+	}
+	if cached == false {
+		defer queue.release(spriteBase, filename)
+	}
+	_, spriteErr = statCached(spriteFile)
+	if spriteErr != nil {
+		sheetName := path.Base(filename) + ".jpg"
+		if req.URL.RawQuery != "" {
+			sheetName += "?" + req.URL.RawQuery
+		}
+		generateErr := generateSprite(ctx, origFile.Name(), sopts, spriteBase, sheetName, ffmpegLogName(req.Header.Get("X-Request-Id")))
+		if generateErr != nil {
+			if errors.Is(generateErr, errEncoderUnavailable) {
+				httpError(rw, req, http.StatusServiceUnavailable, "Encoder unavailable")
+			} else if ctx.Err() == nil {
+				log.Printf("Sprite generation for %s failed: %s", origFile.Name(), generateErr)
+				serveError(rw, req, http.StatusInternalServerError, "Sprite generation failed")
+			}
+			return
+		}
+		cacheAdded(2)
+	}
+	serveCached(rw, req, spriteFile)
+}
+
+// handlePreviewRequest serves /preview/{filename}.webp (or .mp4), a short
+// muted clip of the video at a low resolution for hover previews. It is
+// cached in OutputDir/previews.
+func handlePreviewRequest(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/preview/")
+	ext := path.Ext(name)
+	if ext != ".webp" && ext != ".mp4" {
+		httpError(rw, req, http.StatusNotFound, "Not Found")
+		return
+	}
+	filename := cleanFilename(strings.TrimSuffix(name, ext))
+	if filename == "" {
+		httpError(rw, req, http.StatusBadRequest, "Invalid Filename")
+		return
+	}
+	popts, msg := parsePreviewOptions(req.URL.Query())
+	if msg != "" {
+		httpError(rw, req, http.StatusBadRequest, msg)
+		return
+	}
+	origFile := openSource(rw, req, filename)
+	if origFile == nil {
+		return
+	}
+	defer origFile.Close()
+	previewFile := fmt.Sprintf("%s.%ss-%ss-%dw",
+		path.Join(config.OutputDir, "previews", filename),
+		strconv.FormatFloat(popts.Start, 'f', -1, 64), strconv.FormatFloat(popts.Duration, 'f', -1, 64), popts.Width)
+	if config.CacheVersion != "" {
+		previewFile += "-" + config.CacheVersion
+	}
+	previewFile += ext
+	_, previewErr := statCached(previewFile)
+	if previewErr == nil {
+		serveCached(rw, req, previewFile)
+		return
+	}
+	ctx := req.Context()
+	cached, queueErr := acquireOutput(ctx, previewFile, filename, func() bool {
+		_, statErr := statCached(previewFile)
+		return statErr == nil
+	})
+	if queueErr == errQueueFull {
+		rw.Header().Set("Retry-After", "5")
+		httpError(rw, req, http.StatusServiceUnavailable, "Too many requests queued")
+		return
+	}
+	if queueErr != nil {
+		return
+	}
+	if cached == false {
+		defer queue.release(previewFile, filename)
+	}
+	_, previewErr = statCached(previewFile)
+	if previewErr != nil {
+		generateErr := generatePreview(ctx, origFile.Name(), popts, previewFile, ffmpegLogName(req.Header.Get("X-Request-Id")))
+		if generateErr != nil {
+			if generateErr == errPreviewRange {
+				httpError(rw, req, http.StatusBadRequest, "Invalid t")
+			} else if errors.Is(generateErr, errEncoderUnavailable) {
+				httpError(rw, req, http.StatusServiceUnavailable, "Encoder unavailable")
+			} else if ctx.Err() == nil {
+				log.Printf("Preview generation for %s failed: %s", origFile.Name(), generateErr)
+				serveError(rw, req, http.StatusInternalServerError, "Preview generation failed")
+			}
+			return
+		}
+		cacheAdded(1)
+	}
+	serveCached(rw, req, previewFile)
+}
+
+// handleAutoRequest serves /auto/{filename}?bandwidth=, the largest of
+// the Widths whose bitrate fits in the client's bandwidth, as a request
+// for that width would. Without a bandwidth it is the DefaultWidth.
+func handleAutoRequest(rw http.ResponseWriter, req *http.Request) {
+	// OPTIONS is answered by handleTranscodeRequest.
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && req.Method != http.MethodOptions {
+		rw.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	filename := cleanFilename(strings.TrimPrefix(req.URL.Path, "/auto/"))
+	if filename == "" {
+		httpError(rw, req, http.StatusBadRequest, "Invalid Filename")
+		return
+	}
+	query := req.URL.Query()
+	width := config.DefaultWidth
+	bandwidth := query.Get("bandwidth")
+	if bandwidth != "" {
+		if bitrateRegex.MatchString(bandwidth) == false || parseBitrate(bandwidth) <= 0 {
+			httpError(rw, req, http.StatusBadRequest, "Invalid bandwidth")
+			return
+		}
+		codec := "h264"
+		if config.Codec != "" && query.Get("fallback") != "h264" {
+			codec = config.Codec
+		}
+		width = bandwidthWidth(codec, parseBitrate(bandwidth))
+	}
+	if width == 0 {
+		httpError(rw, req, http.StatusBadRequest, "Invalid bandwidth")
+		return
+	}
+	query.Del("bandwidth")
+	autoReq := req.Clone(req.Context())
+	autoReq.URL.Path = fmt.Sprintf("/%dp/%s", width, filename)
+	autoReq.URL.RawPath = ""
+	autoReq.URL.RawQuery = query.Encode()
+	location := config.PathPrefix + autoReq.URL.Path
+	if autoReq.URL.RawQuery != "" {
+		location += "?" + autoReq.URL.RawQuery
+	}
+	rw.Header().Set("X-Effective-Width", strconv.Itoa(width))
+	rw.Header().Set("Content-Location", location)
+	handleTranscodeRequest(rw, autoReq)
+}
+
+// bandwidthWidth returns the largest of the Widths whose codec bitrate,
+// capped at the MaxVideoBitrate, is no more than bandwidth bits per
+// second, or the smallest of them if none is.
+func bandwidthWidth(codec string, bandwidth int64) int {
+	best := 0
+	smallest := 0
+	for _, width := range config.Widths {
+		bitrate := config.Bitrates[width]
+		if bitrate == "" {
+			bitrate = codecBitrate(codec, width)
+		}
+		rate := parseBitrate(bitrate)
+		if config.MaxVideoBitrate != "" && rate > parseBitrate(config.MaxVideoBitrate) {
+			rate = parseBitrate(config.MaxVideoBitrate)
+		}
+		if rate <= bandwidth && width > best {
+			best = width
+		}
+		if smallest == 0 || width < smallest {
+			smallest = width
+		}
+	}
+	if best == 0 {
+		return smallest
+	}
+	return best
+}
+
+// handlePipRequest serves /pip/{main}/{overlay}, the main video with the
+// overlay video composited onto a corner of it. It is generated in full
+// and cached in OutputDir/pip before being served.
+func handlePipRequest(rw http.ResponseWriter, req *http.Request) {
+	if config.AllowPictureInPicture == false {
+		httpError(rw, req, http.StatusNotFound, "Not Found")
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	mainName, overlayName := splitPipPath(strings.TrimPrefix(req.URL.Path, "/pip/"))
+	if mainName == "" || overlayName == "" {
+		httpError(rw, req, http.StatusBadRequest, "Invalid Filename")
+		return
+	}
+	pipts, msg := parsePipOptions(req.URL.Query())
+	if msg != "" {
+		httpError(rw, req, http.StatusBadRequest, msg)
+		return
+	}
+	mainFile := openSource(rw, req, mainName)
+	if mainFile == nil {
+		return
+	}
+	defer mainFile.Close()
+	overlayFile := openSource(rw, req, overlayName)
+	if overlayFile == nil {
+		return
+	}
+	defer overlayFile.Close()
+	rw.Header().Set("Content-Type", "video/mp4")
+	pipFile := pipts.cacheFile(mainName, overlayName)
+	_, pipErr := statCached(pipFile)
+	if pipErr == nil {
+		serveCached(rw, req, pipFile)
+		return
+	}
+	ctx := req.Context()
+	cached, queueErr := acquireOutput(ctx, pipFile, mainName, func() bool {
+		_, statErr := statCached(pipFile)
+		return statErr == nil
+	})
+	if queueErr == errQueueFull {
+		rw.Header().Set("Retry-After", "5")
+		httpError(rw, req, http.StatusServiceUnavailable, "Too many requests queued")
+		return
+	}
+	if queueErr != nil {
+		return
+	}
+	if cached == false {
+		defer queue.release(pipFile, mainName)
+	}
+	_, pipErr = statCached(pipFile)
+	if pipErr != nil {
+		generateErr := generatePip(ctx, mainFile.Name(), overlayFile.Name(), pipts, pipFile, ffmpegLogName(req.Header.Get("X-Request-Id")))
+		if generateErr != nil {
+			if errors.Is(generateErr, errEncoderUnavailable) {
+				httpError(rw, req, http.StatusServiceUnavailable, "Encoder unavailable")
+			} else if ctx.Err() == nil {
+				log.Printf("Picture-in-picture of %s and %s failed: %s", mainFile.Name(), overlayFile.Name(), generateErr)
+				serveError(rw, req, http.StatusInternalServerError, "Transcoding failed")
+			}
+			return
+		}
+		cacheAdded(1)
+	}
+	serveCached(rw, req, pipFile)
+}
+
+// splitPipPath splits name into the main and overlay filenames. Either
+// may be in a subdirectory, the main one ends at the first prefix of name
+// that is a file in InputDir, as nothing further down can be a file too.
+func splitPipPath(name string) (string, string) {
+	segments := strings.Split(name, "/")
+	for ii := 1; ii < len(segments); ii++ {
+		mainName := cleanFilename(strings.Join(segments[:ii], "/"))
+		if mainName == "" {
+			continue
+		}
+		info, statErr := os.Stat(path.Join(config.InputDir, mainName))
+		if statErr == nil && info.Mode().IsRegular() {
+			return mainName, cleanFilename(strings.Join(segments[ii:], "/"))
+		}
+	}
+	return "", ""
+}
+
+// handleCancelRequest serves POST /cancel/{width}p/{filename} and tears
+// down every in-flight transcode of that output. Clients still waiting for
+// a transcode slot get a 409.
+func handleCancelRequest(rw http.ResponseWriter, req *http.Request) {
+	if requireAdmin(rw, req) == false {
+		return
+	}
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	treq, status, msg := parseTranscodeRequest(req, strings.TrimPrefix(req.URL.Path, "/cancel"))
+	if treq == nil {
+		httpError(rw, req, status, msg)
+		return
+	}
+	if jobs.cancel(treq.cacheFile()) == 0 {
+		httpError(rw, req, http.StatusNotFound, "No active transcode")
+		return
+	}
+	rw.Write([]byte("Cancelled"))
+}
+
+// primeKey is the request context key of the job handlePrimeRequest
+// registered for the transcode it runs through handleTranscodeRequest.
+type primeKey struct{}
+
+// handlePrimeRequest serves POST /prime/{width}p/{filename}, which
+// transcodes that output into the cache in the background, ahead of the
+// clients asking for it. A prime of an output that is already being
+// transcoded or queued, such as a scheduler's retry, shares that job
+// instead of starting another, so that priming is idempotent. Either way
+// the job's status is returned.
+func handlePrimeRequest(rw http.ResponseWriter, req *http.Request) {
+	if requireAdmin(rw, req) == false {
+		return
+	}
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	treq, status, msg := parseTranscodeRequest(req, strings.TrimPrefix(req.URL.Path, "/prime"))
+	if treq == nil {
+		httpError(rw, req, status, msg)
+		return
+	}
+	if treq.opts.LowLatency {
+		httpError(rw, req, http.StatusBadRequest, "Low-latency outputs aren't cached")
+		return
+	}
+	origFile := openSource(rw, req, treq.filename)
+	if origFile == nil {
+		return
+	}
+	origFile.Close()
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if treq.cachedFile() != "" {
+		json.NewEncoder(rw).Encode(jobStatus{Filename: treq.filename, Width: treq.opts.Width, State: "cached"})
+		return
+	}
+	trFileName := treq.cacheFile()
+	ctx, cancel := context.WithCancel(context.Background())
+	job, added := jobs.addOnce(trFileName, treq, req, cancel)
+	if added == false {
+		cancel()
+		json.NewEncoder(rw).Encode(jobs.status(job))
+		return
+	}
+	primeURL := &url.URL{Path: treq.canonicalPath(), RawQuery: req.URL.RawQuery}
+	primeReq, _ := http.NewRequestWithContext(context.WithValue(ctx, primeKey{}, job), http.MethodGet, primeURL.String(), nil)
+	primeReq.Header.Set("X-Request-Id", req.Header.Get("X-Request-Id"))
+	primeReq.Header.Set("X-Tenant", req.Header.Get("X-Tenant"))
+	go func() {
+		defer cancel()
+		defer jobs.remove(job)
+		primeRW := &primeWriter{header: make(http.Header)}
+		handleTranscodeRequest(primeRW, primeReq)
+		if primeRW.status >= http.StatusBadRequest {
+			log.Printf("Prime of %s failed with %d", primeURL.Path, primeRW.status)
+		}
+	}()
+	rw.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(rw).Encode(jobs.status(job))
+}
+
+// primeWriter is the ResponseWriter of primes, which only need the
+// output to end up in the cache.
+type primeWriter struct {
+	header http.Header
+	status int
+}
+
+func (rw *primeWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *primeWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *primeWriter) Write(data []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return len(data), nil
+}
+
+func (rw *primeWriter) Flush() {
+}
+
+// handleReloadRequest serves POST /admin/reload, which reloads the
+// Catalog and Denylist like a SIGHUP does, and answers whether that
+// worked.
+func handleReloadRequest(rw http.ResponseWriter, req *http.Request) {
+	if requireAdmin(rw, req) == false {
+		return
+	}
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	rules, reloadErr := reloadSources()
+	if reloadErr != nil {
+		log.Printf("Reload failed, keeping the current Catalog and Denylist: %s", reloadErr)
+		httpError(rw, req, http.StatusUnprocessableEntity, reloadErr.Error())
+		return
+	}
+	fmt.Fprintf(rw, "Reloaded %d catalog entries and %d denylist patterns", len(rules.catalog), len(rules.denylist))
+}
+
+// handleJobsRequest lists the in-flight transcodes as JSON.
+func handleJobsRequest(rw http.ResponseWriter, req *http.Request) {
+	if requireAdmin(rw, req) == false {
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("X-Queue-Length", strconv.Itoa(queue.length()))
+	json.NewEncoder(rw).Encode(jobs.list())
+}
+
+// handleStatsRequest serves GET /admin/stats, a summary of the counters
+// since the server started.
+func handleStatsRequest(rw http.ResponseWriter, req *http.Request) {
+	if requireAdmin(rw, req) == false {
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(stats.snapshot())
+}
+
+// purgeResult is the response of DELETE /admin/cache/{filename}.
+type purgeResult struct {
+	Removed  int    `json:"removed"`
+	InFlight string `json:"inFlight"`
+}
+
+// handlePurgeRequest serves DELETE /admin/cache/{filename}, removing
+// every cached output of the source once its in-flight transcodes are
+// out of the way, see PurgeInFlight.
+func handlePurgeRequest(rw http.ResponseWriter, req *http.Request) {
+	if requireAdmin(rw, req) == false {
+		return
+	}
+	if req.Method != http.MethodDelete {
+		rw.Header().Set("Allow", http.MethodDelete)
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	filename := cleanFilename(strings.TrimPrefix(req.URL.Path, "/admin/cache/"))
+	if filename == "" {
+		httpError(rw, req, http.StatusBadRequest, "Invalid Filename")
+		return
+	}
+	mode := config.PurgeInFlight
+	if req.URL.Query().Get("inflight") != "" {
+		mode = req.URL.Query().Get("inflight")
+	}
+	if mode != "" && mode != "wait" && mode != "cancel" {
+		httpError(rw, req, http.StatusBadRequest, "Invalid inflight")
+		return
+	}
+	inFlight, settleErr := settleInFlight(req.Context(), filename, mode == "cancel")
+	if settleErr != nil {
+		// The client gave up waiting, the cache is left as it was.
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(purgeResult{Removed: purgeSource(filename), InFlight: inFlight})
+}
+
+// settleInFlight waits until no transcode of the source filename is in
+// flight, cancelling them first when cancel is set, so that none of them
+// puts an output back in the cache after a purge. It returns "none" when
+// there were none, "waited" or "cancelled" otherwise, or ctx's error when
+// it is done first.
+func settleInFlight(ctx context.Context, filename string, cancel bool) (string, error) {
+	outcome := "none"
+	for {
+		pending := jobs.ofSource(filename, cancel)
+		if len(pending) == 0 {
+			return outcome, nil
+		}
+		outcome = "waited"
+		if cancel {
+			outcome = "cancelled"
+		}
+		for _, done := range pending {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return outcome, ctx.Err()
+			}
+		}
+	}
+}
+
+// handleOriginalRequest serves GET /original/{filename}, the source file
+// itself as a download, for the editors who need the master.
+func handleOriginalRequest(rw http.ResponseWriter, req *http.Request) {
+	if requireAdmin(rw, req) == false {
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	filename := cleanFilename(strings.TrimPrefix(req.URL.Path, "/original/"))
+	if filename == "" {
+		httpError(rw, req, http.StatusBadRequest, "Invalid Filename")
+		return
+	}
+	origFile := openSource(rw, req, filename)
+	if origFile == nil {
+		return
+	}
+	defer origFile.Close()
+	origInfo, statErr := origFile.Stat()
+	if statErr != nil {
+		httpError(rw, req, http.StatusInternalServerError, "Could not read source file")
+		return
+	}
+	downloadName := path.Base(filename)
+	if req.URL.Query().Get("download") != "" {
+		downloadName = sanitizeDownloadName(req.URL.Query().Get("download"))
+		if downloadName == "" {
+			httpError(rw, req, http.StatusBadRequest, "Invalid download")
+			return
+		}
+	}
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": downloadName}))
+	rw.Header().Set("Cache-Control", "private")
+	http.ServeContent(rw, req, path.Base(filename), origInfo.ModTime(), origFile)
+}
+
+// videoInfo is the JSON served by /info/{filename}. Width and Height are
+// the display size, swapped from the coded size of sources rotated by 90
+// or 270 degrees.
+type videoInfo struct {
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Rotation int     `json:"rotation"`
+	Duration float64 `json:"duration"`
+}
+
+// handleInfoRequest serves GET /info/{filename}, the dimensions and
+// length of the source file, for frontends to size their players.
+func handleInfoRequest(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		httpError(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	filename := cleanFilename(strings.TrimPrefix(req.URL.Path, "/info/"))
+	if filename == "" {
+		httpError(rw, req, http.StatusBadRequest, "Invalid Filename")
+		return
+	}
+	origFile := openSource(rw, req, filename)
+	if origFile == nil {
+		return
+	}
+	defer origFile.Close()
+	probe, probeErr := probeFile(req.Context(), origFile.Name())
+	if probeErr != nil {
+		log.Printf("Could not probe %s: %s", origFile.Name(), probeErr)
+		httpError(rw, req, http.StatusInternalServerError, "Could not probe source file")
+		return
+	}
+	info := videoInfo{Duration: probe.duration()}
+	video := probe.videoStream()
+	if video != nil {
+		info.Width, info.Height = video.displaySize()
+		info.Rotation = video.rotation()
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(info)
+}
+
+// maxDownloadNameLength is the longest ?download= name kept, in
+// characters.
+const maxDownloadNameLength = 100
+
+// sanitizeDownloadName turns the ?download= value into a plain file name
+// for Content-Disposition: no directories, control characters or leading
+// dots, and at most maxDownloadNameLength characters, extension included.
+// It returns "" when nothing is left.
+func sanitizeDownloadName(name string) string {
+	name = name[strings.LastIndexAny(name, "/\\")+1:]
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if utf8.RuneCountInString(name) > maxDownloadNameLength {
+		// Shorten the name but keep the extension.
+		ext := path.Ext(name)
+		if utf8.RuneCountInString(ext) > maxDownloadNameLength/2 {
+			ext = ""
+		}
+		runes := []rune(strings.TrimSuffix(name, ext))
+		name = strings.TrimSpace(string(runes[:maxDownloadNameLength-utf8.RuneCountInString(ext)])) + ext
+	}
+	return name
+}
+
+// webhookEvent is the payload POSTed to the WebhookURL.
+type webhookEvent struct {
+	Filename        string            `json:"filename"`
+	Width           int               `json:"width"`
+	Params          map[string]string `json:"params"`
+	Status          string            `json:"status"`
+	DurationSeconds float64           `json:"durationSeconds"`
+	OutputBytes     int64             `json:"outputBytes"`
+}
+
+// notifyWebhook tells the WebhookURL about a finished transcode in the
+// background. status is "completed", "failed" or "cancelled", and
+// outputFile is where the output was cached, if it was.
+func notifyWebhook(treq *transcodeRequest, status string, elapsed time.Duration, outputFile string) {
+	if config.WebhookURL == "" {
+		return
+	}
+	event := webhookEvent{
+		Filename:        treq.filename,
+		Width:           treq.opts.Width,
+		Params:          make(map[string]string),
+		Status:          status,
+		DurationSeconds: elapsed.Seconds(),
+	}
+	for key, values := range cacheParams(treq.opts) {
+		event.Params[key] = values[0]
+	}
+	if status == "completed" {
+		info, statErr := os.Stat(outputFile)
+		if statErr == nil {
+			event.OutputBytes = info.Size()
+		}
+	}
+	body, _ := json.Marshal(event)
+	go postWebhook(body)
+}
+
+// postWebhook POSTs body to the WebhookURL, with an X-Signature header
+// carrying its HMAC-SHA256 under the WebhookSecret. Failed deliveries
+// are retried three times, a second, then 2s and 4s later.
+func postWebhook(body []byte) {
+	mac := hmac.New(sha256.New, []byte(config.WebhookSecret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	client := &http.Client{Timeout: 10 * time.Second}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		hookReq, reqErr := http.NewRequest(http.MethodPost, config.WebhookURL, bytes.NewReader(body))
+		if reqErr != nil {
+			log.Printf("Invalid WebhookURL: %s", reqErr)
+			return
+		}
+		hookReq.Header.Set("Content-Type", "application/json")
+		hookReq.Header.Set("X-Signature", signature)
+		resp, postErr := client.Do(hookReq)
+		if postErr == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			postErr = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		if attempt == 3 {
+			log.Printf("Webhook delivery to %s failed: %s", config.WebhookURL, postErr)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// hasCacheDirective reports whether the Cache-Control header of req
+// carries directive, e.g. "only-if-cached".
+func hasCacheDirective(req *http.Request, directive string) bool {
+	for _, header := range req.Header.Values("Cache-Control") {
+		for _, part := range strings.Split(header, ",") {
+			name := strings.SplitN(strings.TrimSpace(part), "=", 2)[0]
+			if strings.EqualFold(name, directive) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requireAdmin checks the request carries the AdminToken as a bearer
+// token, writing an error response if it doesn't. Admin endpoints are
+// disabled altogether when no AdminToken is configured.
+func requireAdmin(rw http.ResponseWriter, req *http.Request) bool {
+	if config.AdminToken == "" {
+		httpError(rw, req, http.StatusNotFound, "Not Found")
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		httpError(rw, req, http.StatusUnauthorized, "Unauthorized")
+		return false
+	}
+	return true
+}
+
+// httpError writes an error response, as JSON for clients that accept
+// application/json and as plain text otherwise.
+func httpError(rw http.ResponseWriter, req *http.Request, status int, msg string) {
+	// Errors are shown, not saved as the download.
+	rw.Header().Del("Content-Disposition")
+	if acceptsJSON(req) {
+		body, _ := json.Marshal(struct {
+			Error     string `json:"error"`
+			Code      int    `json:"code"`
+			RequestID string `json:"requestId,omitempty"`
+		}{msg, status, req.Header.Get("X-Request-Id")})
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		rw.Write(body)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(status)
+	rw.Write([]byte(msg))
+}
+
+// acceptsJSON reports whether the Accept header lists application/json.
+func acceptsJSON(req *http.Request) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, parseErr := mime.ParseMediaType(strings.TrimSpace(accept))
+		if parseErr == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// newHandler returns the server's routes, wrapped in its middleware.
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleTranscodeRequest)
+	mux.HandleFunc("/cancel/", handleCancelRequest)
+	mux.HandleFunc("/sprite/", handleSpriteRequest)
+	mux.HandleFunc("/preview/", handlePreviewRequest)
+	mux.HandleFunc("/pip/", handlePipRequest)
+	mux.HandleFunc("/admin/jobs", handleJobsRequest)
+	mux.HandleFunc("/admin/stats", handleStatsRequest)
+	mux.HandleFunc("/admin/reload", handleReloadRequest)
+	mux.HandleFunc("/prime/", handlePrimeRequest)
+	mux.HandleFunc("/original/", handleOriginalRequest)
+	mux.HandleFunc("/info/", handleInfoRequest)
+	mux.HandleFunc("/auto/", handleAutoRequest)
+	mux.HandleFunc("/admin/cache/", handlePurgeRequest)
+	return withRequestID(withRecovery(withThrottle(withPathPrefix(mux))))
+}
+
+// withRequestID makes sure every request carries an X-Request-Id, taking
+// the client's (or proxy's) if it sent one, and echoes it back in the
+// response so that errors can be matched up with the logs.
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get("X-Request-Id")
+		if requestID == "" {
+			id := make([]byte, 8)
+			rand.Read(id)
+			requestID = hex.EncodeToString(id)
+			req.Header.Set("X-Request-Id", requestID)
+		}
+		rw.Header().Set("X-Request-Id", requestID)
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// withPathPrefix strips the PathPrefix from request paths, answering a 404
+// for paths outside of it. The paths are cleaned here too, as the redirect
+// the ServeMux would send for unclean ones would lose the prefix.
+func withPathPrefix(handler http.Handler) http.Handler {
+	if config.PathPrefix == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		reqPath := req.URL.Path
+		if reqPath != config.PathPrefix && strings.HasPrefix(reqPath, config.PathPrefix+"/") == false {
+			httpError(rw, req, http.StatusNotFound, "Not Found")
+			return
+		}
+		stripped := path.Clean("/" + strings.TrimPrefix(reqPath, config.PathPrefix))
+		if strings.HasSuffix(reqPath, "/") && stripped != "/" {
+			stripped += "/"
+		}
+		prefixedReq := req.Clone(req.Context())
+		prefixedReq.URL.Path = stripped
+		prefixedReq.URL.RawPath = ""
+		handler.ServeHTTP(rw, prefixedReq)
+	})
+}
+
+// withRecovery turns a panic in handler into a logged stack trace and a
+// 500, instead of a connection left hanging. When the response has
+// already started the connection is dropped, as the client can't be told
+// anything else.
+func withRecovery(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		recoveryRW := &recoveryWriter{ResponseWriter: rw}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			log.Printf("Panic serving %s (request %s): %v\n%s", req.URL.Path, req.Header.Get("X-Request-Id"), recovered, debug.Stack())
+			if recoveryRW.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			httpError(rw, req, http.StatusInternalServerError, "Internal Server Error")
+		}()
+		handler.ServeHTTP(recoveryRW, req)
+	})
+}
+
+// recoveryWriter records whether the response has started for
+// withRecovery.
+type recoveryWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (rw *recoveryWriter) WriteHeader(status int) {
+	rw.wroteHeader = true
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recoveryWriter) Write(data []byte) (int, error) {
+	rw.wroteHeader = true
+	return rw.ResponseWriter.Write(data)
+}
+
+func (rw *recoveryWriter) Flush() {
+	flusher, ok := rw.ResponseWriter.(http.Flusher)
+	if ok {
+		rw.wroteHeader = true
+		flusher.Flush()
+	}
+}
+
+// ReadFrom keeps the underlying ResponseWriter's sendfile support for
+// http.ServeFile.
+func (rw *recoveryWriter) ReadFrom(src io.Reader) (int64, error) {
+	rw.wroteHeader = true
+	return io.Copy(rw.ResponseWriter, src)
+}
+
+// withThrottle limits responses to MaxBytesPerSecond once their first
+// BurstBytes have gone out.
+func withThrottle(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if config.MaxBytesPerSecond <= 0 {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+		throttled := &throttledWriter{ResponseWriter: rw, ctx: req.Context(), rate: config.MaxBytesPerSecond, burst: config.BurstBytes}
+		handler.ServeHTTP(throttled, req)
+	})
+}
+
+// throttledWriter sends the first burst bytes of a response straight
+// away and paces the rest at rate bytes per second. It has no ReadFrom,
+// so that http.ServeFile goes through Write rather than sendfile.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	rate  int64
+	burst int64
+	sent  int64
+	// paced is when the burst ran out.
+	paced time.Time
+}
+
+func (rw *throttledWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		chunk := int64(len(data))
+		if rw.sent < rw.burst {
+			if chunk > rw.burst-rw.sent {
+				chunk = rw.burst - rw.sent
+			}
+		} else {
+			if rw.paced.IsZero() {
+				rw.paced = time.Now()
+			}
+			// Pace in steps of a tenth of a second's worth of bytes at
+			// most, so that the stream stays smooth, each going out once
+			// the rate allows for all of it.
+			step := rw.rate / 10
+			if step < 1 {
+				step = 1
+			}
+			if chunk > step {
+				chunk = step
+			}
+			due := rw.paced.Add(time.Duration(float64(rw.sent+chunk-rw.burst) / float64(rw.rate) * float64(time.Second)))
+			wait := time.Until(due)
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-rw.ctx.Done():
+					timer.Stop()
+					return written, rw.ctx.Err()
+				}
+			}
+		}
+		n, err := rw.ResponseWriter.Write(data[:chunk])
+		written += n
+		rw.sent += int64(n)
+		if err != nil {
+			return written, err
+		}
+		data = data[chunk:]
+	}
+	return written, nil
+}
+
+func (rw *throttledWriter) Flush() {
+	flusher, ok := rw.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// serveError responds with the ErrorPoster (for image requests) or
+// ErrorVideo fallback so that players show something instead of breaking
+// on a text error. It falls back to httpError when no asset is configured.
+func serveError(rw http.ResponseWriter, req *http.Request, status int, msg string) {
+	asset := config.ErrorVideo
+	if config.ErrorPoster != "" && strings.HasPrefix(req.Header.Get("Accept"), "image/") {
+		asset = config.ErrorPoster
+	}
+	if asset == "" {
+		httpError(rw, req, status, msg)
+		return
+	}
+	assetFile, assetErr := os.Open(asset)
+	if assetErr != nil {
+		log.Printf("Could not open error asset %s: %s", asset, assetErr)
+		httpError(rw, req, status, msg)
+		return
+	}
+	defer assetFile.Close()
+	contentType := mime.TypeByExtension(filepath.Ext(asset))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Cache-Control", "no-store")
+	if config.ErrorAssetStatusOK {
+		status = http.StatusOK
+	}
+	rw.WriteHeader(status)
+	io.Copy(rw, assetFile)
+}
+
+// transcodeRequest is a parsed /{width}p/{filename} request.
+type transcodeRequest struct {
+	// namespace is the tenant whose cache the output goes into, or ""
+	// when there are no Tenants.
+	namespace string
+	filename  string
+	opts      TranscodeOptions
+	// defaultWidth is set when the URL had no width and DefaultWidth was
+	// used instead.
+	defaultWidth bool
+	// clampedFrom is the bitrate asked for when it was over the
+	// MaxVideoBitrate.
+	clampedFrom string
+	// capped is set when the width was lowered to the client's maxwidth,
+	// viewport or Save-Data preference.
+	capped bool
+	// attach is cleared by ?attach=false, for clients that would rather
+	// get a 425 than wait while the output is being transcoded.
+	attach bool
+	// now is when the request was parsed, which picks its daily
+	// partition once rather than on every lookup.
+	now time.Time
+}
+
+// parseTranscodeRequest validates the width, filename and query
+// parameters of reqPath, the transcode URL path of req. On failure it
+// returns a nil request along with the status and message to respond
+// with.
+func parseTranscodeRequest(req *http.Request, reqPath string) (*transcodeRequest, int, string) {
+	query := req.URL.Query()
+	for param := range query {
+		if strings.HasPrefix(param, "meta_") {
+			param = "meta"
+		}
+		if stringInSlice(param, encoderOverrides) && stringInSlice(param, config.AllowedOverrides) == false {
+			return nil, http.StatusBadRequest, "Override not allowed: " + param
+		}
+	}
+	namespace := ""
+	if len(config.Tenants) > 0 {
+		namespace = req.Header.Get("X-Tenant")
+		if query.Get("ns") != "" {
+			namespace = query.Get("ns")
+		}
+		if namespace == "" {
+			namespace = "default"
+		}
+		// The namespace ends up in the cache path, so on top of the
+		// allow-list make sure it can't be anything but a plain name.
+		if namespaceRegex.MatchString(namespace) == false || (namespace != "default" && stringInSlice(namespace, config.Tenants) == false) {
+			return nil, http.StatusForbidden, "Unknown namespace"
+		}
+	}
+	// Collapse duplicate slashes and dot segments before matching, so that
+	// /720p//movie.mp4 and /./720p/movie.mp4 are /720p/movie.mp4 too.
+	// The ServeMux already redirects such URLs, this keeps a single cache
+	// path per file however the handler is reached.
+	reqPath = path.Clean("/" + reqPath)
+	ret := urlRegex.FindStringSubmatch(reqPath)
+	defaultWidth := false
+	if ret == nil {
+		if config.DefaultWidth == 0 {
+			return nil, http.StatusNotFound, "Not Found"
+		}
+		// A bare /{filename} gets the DefaultWidth.
+		ret = []string{reqPath, strconv.Itoa(config.DefaultWidth), reqPath}
+		defaultWidth = true
+	}
+	width, widthConvErr := strconv.Atoi(ret[1])
+	if widthConvErr != nil {
+		return nil, http.StatusBadRequest, "Invalid Width"
+	}
+	found := false
+	for _, ii := range config.Widths {
+		if ii == width {
+			found = true
+		}
+	}
+	if found == false {
+		// The width is well-formed, it just isn't offered. List the ones
+		// that are so that clients can pick another.
+		available := make([]string, len(config.Widths))
+		for ii, width := range config.Widths {
+			available[ii] = strconv.Itoa(width)
+		}
+		return nil, http.StatusNotAcceptable, "Available: " + strings.Join(available, ",")
+	}
+	// Clients can cap the width to their viewport, with ?maxwidth= or the
+	// Sec-CH-Viewport-Width client hint.
+	maxWidth := 0
+	viewport, viewportErr := strconv.Atoi(req.Header.Get("Sec-CH-Viewport-Width"))
+	if viewportErr == nil && viewport > 0 {
+		maxWidth = viewport
+	}
+	if query.Get("maxwidth") != "" {
+		maxWidthVal, maxWidthErr := strconv.Atoi(query.Get("maxwidth"))
+		if maxWidthErr != nil || maxWidthVal < 1 {
+			return nil, http.StatusBadRequest, "Invalid maxwidth"
+		}
+		maxWidth = maxWidthVal
+	}
+	capped := false
+	if maxWidth > 0 && width > maxWidth {
+		width = cappedWidth(maxWidth)
+		capped = true
+	}
+	if config.RespectSaveData && strings.EqualFold(strings.TrimSpace(req.Header.Get("Save-Data")), "on") {
+		saverWidth := saveDataWidth(width)
+		if saverWidth != width {
+			width = saverWidth
+			capped = true
+		}
+	}
+	opts := TranscodeOptions{Width: width, Loudnorm: config.Loudnorm, Fragmented: config.FragmentedMP4, Codec: "h264"}
+	if config.Codec != "" {
+		opts.Codec = config.Codec
+	}
+	fallback := query.Get("fallback")
+	if fallback != "" {
+		if fallback != "h264" {
+			return nil, http.StatusBadRequest, "Invalid fallback"
+		}
+		opts.Codec = fallback
+	}
+	loudnorm := query.Get("loudnorm")
+	if loudnorm != "" {
+		loudnormVal, loudnormErr := strconv.ParseBool(loudnorm)
+		if loudnormErr != nil {
+			return nil, http.StatusBadRequest, "Invalid loudnorm"
+		}
+		opts.Loudnorm = loudnormVal
+	}
+	opts.TwoPass = config.TwoPass
+	twopass := query.Get("twopass")
+	if twopass != "" {
+		twopassVal, twopassErr := strconv.ParseBool(twopass)
+		if twopassErr != nil {
+			return nil, http.StatusBadRequest, "Invalid twopass"
+		}
+		opts.TwoPass = twopassVal
+	}
+	opts.FPS = config.MaxFPS[width]
+	fps := query.Get("fps")
+	if fps != "" {
+		fpsVal, fpsErr := strconv.Atoi(fps)
+		if fpsErr != nil || fpsVal < 1 || fpsVal > maxFPS {
+			return nil, http.StatusBadRequest, "Invalid fps"
+		}
+		opts.FPS = fpsVal
+	}
+	opts.CFR = config.ConstantFrameRate
+	cfr := query.Get("cfr")
+	if cfr != "" {
+		cfrVal, cfrErr := strconv.Atoi(cfr)
+		if cfrErr != nil || cfrVal < 1 || cfrVal > maxFPS {
+			return nil, http.StatusBadRequest, "Invalid cfr"
+		}
+		opts.CFR = cfrVal
+	}
+	interpolate := query.Get("interpolate")
+	if interpolate != "" {
+		interpolateVal, interpolateErr := strconv.ParseBool(interpolate)
+		if interpolateErr != nil {
+			return nil, http.StatusBadRequest, "Invalid interpolate"
+		}
+		if interpolateVal && config.AllowInterpolation == false {
+			return nil, http.StatusForbidden, "Interpolation not allowed"
+		}
+		if interpolateVal && opts.FPS == 0 {
+			return nil, http.StatusBadRequest, "Interpolation needs an fps"
+		}
+		opts.Interpolate = interpolateVal
+	}
+	opts.Tune = config.Tunes[width]
+	tune := query.Get("tune")
+	if tune != "" {
+		if stringInSlice(tune, x264Tunes) == false {
+			return nil, http.StatusBadRequest, "Invalid tune"
+		}
+		opts.Tune = tune
+	}
+	lowlatency := query.Get("lowlatency")
+	if lowlatency != "" {
+		lowlatencyVal, lowlatencyErr := strconv.ParseBool(lowlatency)
+		if lowlatencyErr != nil {
+			return nil, http.StatusBadRequest, "Invalid lowlatency"
+		}
+		if lowlatencyVal && query.Get("twopass") != "" && opts.TwoPass {
+			return nil, http.StatusBadRequest, "lowlatency can't be combined with twopass"
+		}
+		if lowlatencyVal && tune != "" && tune != "zerolatency" {
+			return nil, http.StatusBadRequest, "lowlatency can't be combined with tune"
+		}
+		opts.LowLatency = lowlatencyVal
+	}
+	if opts.LowLatency {
+		// Low latency wins over a configured default.
+		opts.TwoPass = false
+		opts.Tune = "zerolatency"
+	}
+	opts.Profile = config.Profile
+	profile := query.Get("profile")
+	if profile != "" {
+		if stringInSlice(profile, x264Profiles) == false {
+			return nil, http.StatusBadRequest, "Invalid profile"
+		}
+		opts.Profile = profile
+	}
+	opts.Level = normalizeLevel(config.Level)
+	level := query.Get("level")
+	if level != "" {
+		if stringInSlice(normalizeLevel(level), x264Levels) == false {
+			return nil, http.StatusBadRequest, "Invalid level"
+		}
+		opts.Level = normalizeLevel(level)
+	}
+	if opts.Codec == "h265" {
+		// The profiles and levels are x264's, and x265 lacks some of its
+		// tunes.
+		opts.Profile = ""
+		opts.Level = ""
+		if stringInSlice(opts.Tune, x265Tunes) == false {
+			opts.Tune = ""
+		}
+	}
+	burnsub := query.Get("burnsub")
+	if burnsub != "" {
+		burnsubVal, burnsubErr := strconv.Atoi(burnsub)
+		if burnsubErr != nil || burnsubVal < 0 {
+			return nil, http.StatusBadRequest, "Invalid burnsub"
+		}
+		if config.AllowBurnSubtitles == false {
+			return nil, http.StatusForbidden, "Subtitle burn-in not allowed"
+		}
+		opts.BurnSubtitles = true
+		opts.SubtitleTrack = burnsubVal
+	}
+	// ToneMap only asks for tone mapping, it is dropped for SDR sources
+	// once they have been probed.
+	opts.ToneMap = config.AutoToneMapping
+	tonemap := query.Get("tonemap")
+	if tonemap != "" {
+		if tonemap != "0" && tonemap != "1" {
+			return nil, http.StatusBadRequest, "Invalid tonemap"
+		}
+		if tonemap == "1" && config.ToneMapping == false && config.AutoToneMapping == false {
+			return nil, http.StatusForbidden, "Tone mapping not allowed"
+		}
+		opts.ToneMap = tonemap == "1"
+	}
+	vtrack := query.Get("vtrack")
+	if vtrack != "" {
+		vtrackVal, vtrackErr := strconv.Atoi(vtrack)
+		if vtrackErr != nil || vtrackVal < 0 {
+			return nil, http.StatusBadRequest, "Invalid vtrack"
+		}
+		opts.VideoTrack = vtrackVal
+	}
+	opts.CopyMetadata = config.CopyMetadata
+	opts.MultiAudio = config.MultiAudio
+	audio := query.Get("audio")
+	if audio == "multi" {
+		opts.MultiAudio = true
+	} else if audio == "single" {
+		opts.MultiAudio = false
+	} else if audio != "" {
+		return nil, http.StatusBadRequest, "Invalid audio"
+	}
+	opts.Channels = config.AudioChannels
+	switch query.Get("channels") {
+	case "":
+	case "1", "mono":
+		opts.Channels = 1
+	case "2", "stereo":
+		opts.Channels = 2
+	case "6":
+		opts.Channels = 6
+	default:
+		return nil, http.StatusBadRequest, "Invalid channels"
+	}
+	if opts.Channels > 0 && opts.MultiAudio {
+		if audio == "multi" {
+			return nil, http.StatusBadRequest, "channels can't be combined with audio=multi"
+		}
+		// A single track with the requested layout wins over the default
+		// pair of tracks.
+		opts.MultiAudio = false
+	}
+	for key, value := range config.Metadata {
+		if opts.Metadata == nil {
+			opts.Metadata = make(map[string]string)
+		}
+		opts.Metadata[key] = value
+	}
+	for param, values := range query {
+		if strings.HasPrefix(param, "meta_") == false {
+			continue
+		}
+		key := strings.TrimPrefix(param, "meta_")
+		if metadataKeyRegex.MatchString(key) == false || len(values[0]) > maxMetadataLength {
+			return nil, http.StatusBadRequest, "Invalid metadata"
+		}
+		if opts.Metadata == nil {
+			opts.Metadata = make(map[string]string)
+		}
+		opts.Metadata[key] = values[0]
+	}
+	x265Params := make(map[string]string)
+	for key, value := range config.X265Params {
+		x265Params[key] = value
+	}
+	if query.Get("x265params") != "" {
+		for _, param := range strings.Split(query.Get("x265params"), ":") {
+			keyValue := strings.SplitN(param, "=", 2)
+			if len(keyValue) != 2 || stringInSlice(keyValue[0], x265ParamKeys) == false || x265ParamValueRegex.MatchString(keyValue[1]) == false {
+				return nil, http.StatusBadRequest, "Invalid x265params"
+			}
+			x265Params[keyValue[0]] = keyValue[1]
+		}
+	}
+	// They only apply to libx265, ?fallback=h264 outputs go without.
+	if opts.Codec == "h265" && len(x265Params) > 0 {
+		opts.X265Params = x265Params
+	}
+	// The tags copied from the source are only known once it is probed.
+	opts.ColorPrimaries = fixedColorTag(config.ColorPrimaries)
+	opts.ColorTransfer = fixedColorTag(config.ColorTransfer)
+	opts.ColorSpace = fixedColorTag(config.ColorSpace)
+	quality := query.Get("quality")
+	if quality != "" {
+		if defaultQualities["h264"][quality] == (Quality{}) {
+			return nil, http.StatusBadRequest, "Invalid quality"
+		}
+		if query.Get("bitrate") != "" {
+			return nil, http.StatusBadRequest, "quality can't be combined with bitrate"
+		}
+		if query.Get("twopass") != "" && opts.TwoPass {
+			return nil, http.StatusBadRequest, "quality can't be combined with twopass"
+		}
+		// A constant quality wins over two-pass being the default.
+		opts.TwoPass = false
+		opts.Quality = quality
+	}
+	bitrate := query.Get("bitrate")
+	if bitrate != "" {
+		if bitrateRegex.MatchString(bitrate) == false {
+			return nil, http.StatusBadRequest, "Invalid bitrate"
+		}
+		opts.Bitrate = bitrate
+	} else if opts.TwoPass {
+		opts.Bitrate = config.Bitrates[width]
+		if opts.Bitrate == "" {
+			opts.Bitrate = codecBitrate(opts.Codec, width)
+		}
+	}
+	clampedFrom := ""
+	if config.MaxVideoBitrate != "" {
+		opts.MaxBitrate = config.MaxVideoBitrate
+		if opts.Bitrate != "" && parseBitrate(opts.Bitrate) > parseBitrate(config.MaxVideoBitrate) {
+			clampedFrom = opts.Bitrate
+			opts.Bitrate = config.MaxVideoBitrate
+		}
+	}
+	attach := true
+	if query.Get("attach") != "" {
+		attachVal, attachErr := strconv.ParseBool(query.Get("attach"))
+		if attachErr != nil {
+			return nil, http.StatusBadRequest, "Invalid attach"
+		}
+		attach = attachVal
+	}
+	filename := cleanFilename(ret[2])
+	if filename == "" {
+		return nil, http.StatusBadRequest, "Invalid Filename"
+	}
+	treq := &transcodeRequest{
+		namespace:    namespace,
+		filename:     filename,
+		opts:         opts,
+		defaultWidth: defaultWidth,
+		clampedFrom:  clampedFrom,
+		attach:       attach,
+		capped:       capped,
+		now:          time.Now(),
+	}
+	return treq, 0, ""
+}
+
+// canonicalPath is the /{width}p/{filename} URL of the request.
+func (treq *transcodeRequest) canonicalPath() string {
+	return fmt.Sprintf("/%dp/%s", treq.opts.Width, treq.filename)
+}
+
+// degraded is treq for the audio-only output served instead when the
+// video can't be decoded, see DegradeToAudio.
+func (treq *transcodeRequest) degraded() *transcodeRequest {
+	degraded := *treq
+	degraded.opts.AudioOnly = true
+	return &degraded
+}
+
+// cacheFile is where the output of treq is stored, in the partition of
+// the day the request came in even when its transcode finishes on the
+// next. It doubles as the key identifying the output in the queue and
+// the job registry.
+func (treq *transcodeRequest) cacheFile() string {
+	return treq.cacheFileAt(treq.now)
+}
+
+// cacheFileAt is where a transcode finished at t is stored. Plain
+// renditions are stored as OutputDir/{width}/{filename}, or in the
+// OutputDirs entry of their width instead of OutputDir/{width}, with .mp4
+// appended for extensionless sources. Anything else gets its cacheKey
+// appended, e.g. movie.mp4.<key>.mp4. With daily
+// partitioning both go under an OutputDir/{YYYY-MM-DD} directory, and
+// with Tenants under an OutputDir/{namespace} one before that.
+func (treq *transcodeRequest) cacheFileAt(t time.Time) string {
+	partition := ""
+	if config.CachePartition == "daily" {
+		partition = t.Format("2006-01-02")
+	}
+	dir := path.Join(config.OutputDir, treq.namespace, partition, strconv.Itoa(treq.opts.Width))
+	if widthDir, ok := config.OutputDirs[treq.opts.Width]; ok {
+		dir = path.Join(widthDir, treq.namespace, partition)
+	}
+	name := path.Join(dir, treq.filename)
+	key := cacheKey(treq.opts)
+	if key != "" {
+		name = fmt.Sprintf("%s.%s.mp4", name, key)
+	} else if path.Ext(treq.filename) == "" {
+		// Sources without an extension still get an MP4 named as one.
+		name += ".mp4"
+	}
+	return name
+}
+
+// cachedFile returns the cached transcode for treq, or "" if there isn't
+// one. With daily partitioning, today's partition is searched first and
+// then the CacheLookbackDays before it. With ValidateCacheOnHit, damaged
+// files are removed and treated as missing.
+func (treq *transcodeRequest) cachedFile() string {
+	for day := 0; day <= config.CacheLookbackDays; day++ {
+		name := treq.cacheFileAt(treq.now.AddDate(0, 0, -day))
+		_, statErr := statCached(name)
+		if statErr == nil && config.ValidateCacheOnHit {
+			validErr := validateMP4(name)
+			if validErr != nil {
+				log.Printf("Removing damaged cache file %s: %s", name, validErr)
+				if os.Remove(name) == nil {
+					atomic.AddInt64(&cacheFiles, -1)
+				}
+				statErr = validErr
+			}
+		}
+		if statErr == nil {
+			return name
+		}
+		if config.CachePartition != "daily" {
+			break
+		}
+	}
+	return ""
+}
+
+// validateMP4 walks the top-level boxes of an MP4 file, checking that it
+// starts with an ftyp box, has a moov box and that the boxes add up to
+// the file size, which catches truncated files.
+func validateMP4(name string) error {
+	file, openErr := os.Open(name)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+	info, statErr := file.Stat()
+	if statErr != nil {
+		return statErr
+	}
+	header := make([]byte, 16)
+	offset := int64(0)
+	hasMoov := false
+	for offset < info.Size() {
+		_, readErr := file.ReadAt(header[:8], offset)
+		if readErr != nil {
+			return fmt.Errorf("truncated box header at %d", offset)
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		if offset == 0 && boxType != "ftyp" {
+			return fmt.Errorf("no ftyp box")
+		}
+		switch size {
+		case 0:
+			// The box runs to the end of the file.
+			size = info.Size() - offset
+		case 1:
+			_, readErr = file.ReadAt(header[8:16], offset+8)
+			if readErr != nil {
+				return fmt.Errorf("truncated box header at %d", offset)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if size < 8 {
+			return fmt.Errorf("invalid %q box size at %d", boxType, offset)
+		}
+		if boxType == "moov" {
+			hasMoov = true
+		}
+		offset += size
+	}
+	if offset != info.Size() {
+		return fmt.Errorf("truncated %d bytes short", offset-info.Size())
+	}
+	if hasMoov == false {
+		return fmt.Errorf("no moov box")
+	}
+	return nil
+}
+
+func stringInSlice(str string, list []string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// configFile is the config file main read, if there was one, for
+// reloadSources to read again.
+var configFile string
+
+// sourceRules are a Catalog and a Denylist. A reload swaps them whole, so
+// that a request sees either the old or the new ones, never a mix.
+type sourceRules struct {
+	catalog  map[string]string
+	denylist []string
+}
+
+var sourcesMu sync.RWMutex
+var sources = &sourceRules{}
+
+// currentSources returns the sourceRules in use.
+func currentSources() *sourceRules {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	return sources
+}
+
+// newSourceRules checks the Catalog and Denylist of cfg.
+func newSourceRules(cfg JSONConfig) (*sourceRules, error) {
+	for _, pattern := range cfg.Denylist {
+		_, matchErr := path.Match(pattern, "")
+		if matchErr != nil {
+			return nil, fmt.Errorf("Invalid Denylist pattern %q", pattern)
+		}
+	}
+	for name, file := range cfg.Catalog {
+		for _, entry := range []string{name, file} {
+			if entry == "" || strings.TrimPrefix(path.Clean("/"+entry), "/") != entry {
+				return nil, fmt.Errorf("Invalid Catalog entry %q: %q", name, file)
+			}
+		}
+	}
+	return &sourceRules{catalog: cfg.Catalog, denylist: cfg.Denylist}, nil
+}
+
+// resolve returns the source file to serve for the requested filename,
+// or "" when the filename or the file the Catalog maps it to is denied.
+func (r *sourceRules) resolve(filename string) string {
+	source := filename
+	if mapped, found := r.catalog[filename]; found {
+		source = mapped
+	}
+	for _, pattern := range r.denylist {
+		for _, name := range []string{filename, source} {
+			matched, _ := path.Match(pattern, name)
+			if matched {
+				return ""
+			}
+		}
+	}
+	return source
+}
+
+// reloadSources reads the Catalog and Denylist from the config file and
+// the environment again and swaps them in. The ones in use are kept when
+// the new ones can't be read or are invalid. The rest of the config only
+// changes on a restart.
+func reloadSources() (*sourceRules, error) {
+	var reloaded JSONConfig
+	if configFile != "" {
+		data, readErr := ioutil.ReadFile(configFile)
+		if readErr != nil {
+			return nil, errors.New("Config file not found")
+		}
+		unmarshalErr := json.Unmarshal(data, &reloaded)
+		if unmarshalErr != nil {
+			return nil, errors.New("Invalid Config file")
+		}
+	}
+	envErr := loadConfigEnv(&reloaded)
+	if envErr != nil {
+		return nil, envErr
+	}
+	rules, rulesErr := newSourceRules(reloaded)
+	if rulesErr != nil {
+		return nil, rulesErr
+	}
+	sourcesMu.Lock()
+	sources = rules
+	sourcesMu.Unlock()
+	log.Printf("Reloaded %d Catalog entries and %d Denylist patterns", len(rules.catalog), len(rules.denylist))
+	return rules, nil
+}
+
+// allowedExtension reports whether filename has one of the
+// AllowedExtensions, ignoring case, where "" stands for no extension.
+// Everything is allowed when the list is empty.
+func allowedExtension(filename string) bool {
+	if len(config.AllowedExtensions) == 0 {
+		return true
+	}
+	ext := path.Ext(filename)
+	for _, allowed := range config.AllowedExtensions {
+		// "" allows the files without an extension.
+		if strings.EqualFold(ext, "."+strings.TrimPrefix(allowed, ".")) || (allowed == "" && ext == "") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBitrate returns a bitrate matching bitrateRegex in bits per
+// second.
+func parseBitrate(bitrate string) int64 {
+	multiplier := int64(1)
+	switch bitrate[len(bitrate)-1] {
+	case 'k', 'K':
+		multiplier = 1000
+	case 'm', 'M':
+		multiplier = 1000000
+	}
+	value, _ := strconv.ParseInt(strings.TrimRight(bitrate, "kKmM"), 10, 64)
+	return value * multiplier
+}
+
+// cappedWidth returns the largest of the Widths that is no larger than
+// maxWidth, or the smallest of them if they all are.
+func cappedWidth(maxWidth int) int {
+	best := 0
+	smallest := 0
+	for _, width := range config.Widths {
+		if width <= maxWidth && width > best {
+			best = width
+		}
+		if smallest == 0 || width < smallest {
+			smallest = width
+		}
+	}
+	if best == 0 {
+		return smallest
+	}
+	return best
+}
+
+// saveDataWidth returns the width to serve instead of width to a client
+// saving data: the SaveDataWidth if it is smaller, otherwise the next of
+// the Widths down, or width itself when it is the smallest.
+func saveDataWidth(width int) int {
+	if config.SaveDataWidth > 0 && config.SaveDataWidth < width {
+		return config.SaveDataWidth
+	}
+	lower := 0
+	for _, ii := range config.Widths {
+		if ii < width && ii > lower {
+			lower = ii
+		}
+	}
+	if lower == 0 {
+		return width
+	}
+	return lower
+}
+
+// normalizeLevel drops the ".0" of levels such as "3.0", so that they
+// match x264Levels and share a cache key with "3".
+func normalizeLevel(level string) string {
+	return strings.TrimSuffix(level, ".0")
+}
+
+// codecQuality returns the encoder setting of the quality level for
+// codec, from the CodecQualities or else the defaultQualities.
+func codecQuality(codec string, level string) Quality {
+	quality, ok := config.CodecQualities[codec][level]
+	if ok {
+		return quality
+	}
+	return defaultQualities[codec][level]
+}
+
+// codecBitrate returns the bitrate for codec at width from the
+// CodecBitrates, or else the defaultBitrates. Widths without an entry get
+// the bitrate of the next larger width in the table, or of the largest.
+func codecBitrate(codec string, width int) string {
+	table := make(map[int]string)
+	for tableWidth, bitrate := range defaultBitrates[codec] {
+		table[tableWidth] = bitrate
+	}
+	for tableWidth, bitrate := range config.CodecBitrates[codec] {
+		table[tableWidth] = bitrate
+	}
+	bestWidth := 0
+	largestWidth := 0
+	for tableWidth := range table {
+		if tableWidth > largestWidth {
+			largestWidth = tableWidth
+		}
+		if tableWidth >= width && (bestWidth == 0 || tableWidth < bestWidth) {
+			bestWidth = tableWidth
+		}
+	}
+	if bestWidth == 0 {
+		bestWidth = largestWidth
+	}
+	return table[bestWidth]
+}
+
+// cleanFilename normalises the filename captured from the URL so that
+// "movie.mp4/" and "./movie.mp4" map to the same source and cache file as
+// "movie.mp4". Dot-dot segments can't climb above InputDir. It returns ""
+// when nothing is left of the filename.
+func cleanFilename(raw string) string {
+	filename := path.Clean("/" + strings.TrimRight(raw, "/"))
+	filename = strings.TrimPrefix(filename, "/")
+	if config.CaseInsensitivePaths && filename != "" {
+		return canonicalFilename(filename)
+	}
+	return filename
+}
+
+// canonicalFilename returns filename with the case of each path segment
+// as it is on disk in InputDir, so that Movie.mp4 and movie.mp4 share a
+// cache entry. An exact match wins over a case-insensitive one. Segments
+// that can't be found are left as they are.
+func canonicalFilename(filename string) string {
+	segments := strings.Split(filename, "/")
+	dir := config.InputDir
+	for ii, segment := range segments {
+		entries, readErr := ioutil.ReadDir(dir)
+		if readErr != nil {
+			break
+		}
+		match := ""
+		for _, entry := range entries {
+			if entry.Name() == segment {
+				match = segment
+				break
+			}
+			if match == "" && strings.EqualFold(entry.Name(), segment) {
+				match = entry.Name()
+			}
+		}
+		if match == "" {
+			break
+		}
+		segments[ii] = match
+		dir = path.Join(dir, match)
+	}
+	return strings.Join(segments, "/")
+}
+
+// errKeyReleased is returned by acquire in demand mode when the slot held
+// for the same key was released while waiting, without a slot.
+var errKeyReleased = errors.New("transcode of the same output over")
+
+// transcodeWaiter is a request parked in the transcodeQueue until a
+// transcode slot frees up.
+type transcodeWaiter struct {
+	key   string
+	file  string
+	ready chan struct{}
+	// released is set when ready is closed because the slot held for
+	// key was released, rather than to hand over a slot.
+	released bool
+}
+
+// errQueueFull is returned by acquire when MaxQueueLength requests are
+// already waiting.
+var errQueueFull = errors.New("transcode queue full")
+
+// transcodeQueue limits how many transcodes run at once, overall and per
+// source file. Requests over the limits wait in arrival order; in demand
+// mode the next slot goes to the output with the most waiting clients
+// instead, and an output that already holds a slot gets no other: its
+// waiters are woken once it is released, see acquireOutput.
+type transcodeQueue struct {
+	mu         sync.Mutex
+	limit      int
+	fileLimit  int
+	maxWaiting int
+	demand     bool
+	running    int
+	perFile    map[string]int
+	waiting    []*transcodeWaiter
+	counts     map[string]int
+	// held counts the slots held per key.
+	held map[string]int
+}
+
+func newTranscodeQueue(limit int, fileLimit int, maxWaiting int, demand bool) *transcodeQueue {
+	return &transcodeQueue{
+		limit:      limit,
+		fileLimit:  fileLimit,
+		maxWaiting: maxWaiting,
+		demand:     demand,
+		perFile:    make(map[string]int),
+		counts:     make(map[string]int),
+		held:       make(map[string]int),
+	}
+}
+
+// acquire blocks until a transcode slot is available for key, an output
+// of the source file, or ctx is done. It returns errQueueFull straight
+// away when it would have to wait behind maxWaiting others. Every
+// successful acquire must be paired with a release.
+func (q *transcodeQueue) acquire(ctx context.Context, key string, file string) error {
+	w := &transcodeWaiter{key: key, file: file, ready: make(chan struct{})}
+	q.mu.Lock()
+	q.waiting = append(q.waiting, w)
+	q.counts[key]++
+	q.dispatch()
+	if q.maxWaiting > 0 && len(q.waiting) > q.maxWaiting && q.waiting[len(q.waiting)-1] == w {
+		q.waiting = q.waiting[:len(q.waiting)-1]
+		q.forget(key)
+		q.mu.Unlock()
+		atomic.AddInt64(&queueRejected, 1)
+		return errQueueFull
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		if w.released {
+			return errKeyReleased
+		}
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for ii, ww := range q.waiting {
+			if ww == w {
+				q.waiting = append(q.waiting[:ii], q.waiting[ii+1:]...)
+				q.forget(key)
+				return ctx.Err()
+			}
+		}
+		if w.released {
+			return ctx.Err()
+		}
+		// The slot was handed over just as the client went away, pass
+		// it on to the next waiter.
+		q.free(key, file)
+		return ctx.Err()
+	}
+}
+
+// acquireOutput is queue.acquire for the output key of file, which
+// cached reports to be in the cache. Rather than transcode key a second
+// time, it waits for a running transcode of key to be over, and returns
+// true without a slot when its output is cached by then.
+func acquireOutput(ctx context.Context, key string, file string, cached func() bool) (bool, error) {
+	for {
+		queueErr := queue.acquire(ctx, key, file)
+		if queueErr != errKeyReleased {
+			return false, queueErr
+		}
+		if cached() {
+			return true, nil
+		}
+	}
+}
+
+// length returns the number of requests waiting for a slot.
+func (q *transcodeQueue) length() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+func (q *transcodeQueue) release(key string, file string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.free(key, file)
+}
+
+// free returns a slot held for key of file and hands it on. q.mu must be
+// held.
+func (q *transcodeQueue) free(key string, file string) {
+	q.running--
+	q.perFile[file]--
+	if q.perFile[file] <= 0 {
+		delete(q.perFile, file)
+	}
+	q.held[key]--
+	if q.held[key] <= 0 {
+		delete(q.held, key)
+		if q.demand {
+			// The waiters for the same output get to look in the cache
+			// before they take a slot of their own.
+			waiting := q.waiting[:0]
+			for _, w := range q.waiting {
+				if w.key == key {
+					w.released = true
+					q.forget(key)
+					close(w.ready)
+				} else {
+					waiting = append(waiting, w)
+				}
+			}
+			q.waiting = waiting
+		}
+	}
+	q.dispatch()
+}
+
+// dispatch hands out free slots to the waiters whose file is under its
+// own limit. q.mu must be held.
+func (q *transcodeQueue) dispatch() {
+	for q.limit <= 0 || q.running < q.limit {
+		next := -1
+		for ii, w := range q.waiting {
+			if q.fileLimit > 0 && q.perFile[w.file] >= q.fileLimit {
+				continue
+			}
+			if q.demand && q.held[w.key] > 0 {
+				continue
+			}
+			if next == -1 {
+				next = ii
+				if q.demand == false {
+					break
+				}
+			} else if q.counts[w.key] > q.counts[q.waiting[next].key] {
+				next = ii
+			}
+		}
+		if next == -1 {
+			return
+		}
+		w := q.waiting[next]
+		q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+		q.forget(w.key)
+		q.running++
+		q.perFile[w.file]++
+		q.held[w.key]++
+		close(w.ready)
+	}
+}
+
+func (q *transcodeQueue) forget(key string) {
+	q.counts[key]--
+	if q.counts[key] <= 0 {
+		delete(q.counts, key)
+	}
+}
+
+// transcodeJob is a transcode that has been requested and hasn't
+// finished yet, whether it is still queued or already running.
+type transcodeJob struct {
+	id       string
+	key      string
+	filename string
+	opts     TranscodeOptions
+	// uri and namespace are what it takes to request the job again.
+	uri       string
+	namespace string
+	started   time.Time
+	cancel    context.CancelFunc
+	cancelled bool
+	// running is set once the job has a transcode slot.
+	running bool
+	// bytes is the streamed output so far, updated atomically.
+	bytes int64
+	// done is closed once the job is over and its output either in the
+	// cache or gone.
+	done chan struct{}
+}
+
+// jobStatus describes a transcodeJob in the GET /admin/jobs listing and
+// the POST /prime responses.
+type jobStatus struct {
+	ID             string            `json:"id,omitempty"`
+	Filename       string            `json:"filename"`
+	Width          int               `json:"width"`
+	Params         map[string]string `json:"params"`
+	State          string            `json:"state"`
+	Started        time.Time         `json:"started"`
+	ElapsedSeconds float64           `json:"elapsedSeconds"`
+	Bytes          int64             `json:"bytes"`
+	Requests       int               `json:"requests"`
+}
+
+// jobRegistry tracks the in-flight transcodes by their cache file.
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string][]*transcodeJob
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: make(map[string][]*transcodeJob)}
+}
+
+func (r *jobRegistry) add(key string, treq *transcodeRequest, req *http.Request, cancel context.CancelFunc) *transcodeJob {
+	job := newTranscodeJob(key, treq, req, cancel)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[key] = append(r.jobs[key], job)
+	return job
+}
+
+// addOnce adds a job for key unless there is one already, which it
+// returns instead. It reports whether the job was added.
+func (r *jobRegistry) addOnce(key string, treq *transcodeRequest, req *http.Request, cancel context.CancelFunc) (*transcodeJob, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.jobs[key]) > 0 {
+		return r.jobs[key][0], false
+	}
+	job := newTranscodeJob(key, treq, req, cancel)
+	r.jobs[key] = append(r.jobs[key], job)
+	return job, true
+}
+
+func newTranscodeJob(key string, treq *transcodeRequest, req *http.Request, cancel context.CancelFunc) *transcodeJob {
+	id := make([]byte, 8)
+	rand.Read(id)
+	uri := treq.canonicalPath()
+	if req.URL.RawQuery != "" {
+		uri += "?" + req.URL.RawQuery
+	}
+	return &transcodeJob{
+		id:        hex.EncodeToString(id),
+		key:       key,
+		filename:  treq.filename,
+		opts:      treq.opts,
+		uri:       uri,
+		namespace: treq.namespace,
+		started:   time.Now(),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+func (r *jobRegistry) remove(job *transcodeJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	close(job.done)
+	list := r.jobs[job.key]
+	for ii, jj := range list {
+		if jj == job {
+			list = append(list[:ii], list[ii+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(r.jobs, job.key)
+	} else {
+		r.jobs[job.key] = list
+	}
+}
+
+// cancel cancels all the jobs for key and returns how many there were.
+func (r *jobRegistry) cancel(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, job := range r.jobs[key] {
+		job.cancelled = true
+		job.cancel()
+	}
+	return len(r.jobs[key])
+}
+
+// ofSource returns the done channels of the jobs transcoding the source
+// filename, at any width and with any options, cancelling them first when
+// cancel is set.
+func (r *jobRegistry) ofSource(filename string, cancel bool) []chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending := []chan struct{}{}
+	for _, list := range r.jobs {
+		for _, job := range list {
+			if job.filename != filename {
+				continue
+			}
+			if cancel {
+				job.cancelled = true
+				job.cancel()
+			}
+			pending = append(pending, job.done)
+		}
+	}
+	return pending
+}
+
+func (r *jobRegistry) cancelled(job *transcodeJob) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return job.cancelled
+}
+
+// active reports whether key is being transcoded or waiting for a slot.
+func (r *jobRegistry) active(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.jobs[key]) > 0
+}
+
+// start marks job as having got its transcode slot.
+func (r *jobRegistry) start(job *transcodeJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job.running = true
+}
+
+// list describes every job, oldest first. Requests counts the jobs for
+// the same output, including the job itself. They are transcodes of their
+// own, unless demand scheduling has them wait for the running one.
+func (r *jobRegistry) list() []jobStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	statuses := []jobStatus{}
+	for _, list := range r.jobs {
+		for _, job := range list {
+			statuses = append(statuses, job.status(len(list), now))
+		}
+	}
+	sort.Slice(statuses, func(ii, jj int) bool {
+		return statuses[ii].Started.Before(statuses[jj].Started)
+	})
+	return statuses
+}
+
+// status describes job as list does.
+func (r *jobRegistry) status(job *transcodeJob) jobStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return job.status(len(r.jobs[job.key]), time.Now())
+}
+
+// status describes job, one of requests jobs for the same output, at
+// now. The registry's lock must be held.
+func (job *transcodeJob) status(requests int, now time.Time) jobStatus {
+	params := make(map[string]string)
+	for key, values := range cacheParams(job.opts) {
+		params[key] = values[0]
+	}
+	state := "queued"
+	if job.running {
+		state = "running"
+	}
+	return jobStatus{
+		ID:             job.id,
+		Filename:       job.filename,
+		Width:          job.opts.Width,
+		Params:         params,
+		State:          state,
+		Started:        job.started,
+		ElapsedSeconds: now.Sub(job.started).Seconds(),
+		Bytes:          atomic.LoadInt64(&job.bytes),
+		Requests:       requests,
+	}
+}
+
+// savedJob is an in-flight transcode as recorded in the StateFile.
+type savedJob struct {
+	URI       string `json:"uri"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// saved lists the outputs being transcoded, once each, however many
+// clients are waiting for them.
+func (r *jobRegistry) saved() []savedJob {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	saved := []savedJob{}
+	for _, list := range r.jobs {
+		if len(list) > 0 {
+			saved = append(saved, savedJob{URI: list[0].uri, Namespace: list[0].namespace})
+		}
+	}
+	return saved
+}
+
+// saveJobs writes the in-flight transcodes to the StateFile.
+func saveJobs() {
+	saved := jobs.saved()
+	if len(saved) == 0 {
+		return
+	}
+	data, _ := json.Marshal(saved)
+	writeErr := ioutil.WriteFile(config.StateFile, data, 0644)
+	if writeErr != nil {
+		log.Printf("Error saving in-flight transcodes: %v", writeErr)
+		return
+	}
+	log.Printf("Saved %d in-flight transcodes to %s", len(saved), config.StateFile)
+}
+
+// loadJobs reads and removes the StateFile, returning the transcodes it
+// records. Missing or unreadable files are treated as empty.
+func loadJobs() []savedJob {
+	data, readErr := ioutil.ReadFile(config.StateFile)
+	if readErr != nil {
+		if os.IsNotExist(readErr) == false {
+			log.Printf("Error reading %s: %v", config.StateFile, readErr)
+		}
+		return nil
+	}
+	var saved []savedJob
+	unmarshalErr := json.Unmarshal(data, &saved)
+	if unmarshalErr != nil {
+		log.Printf("Error reading %s: %v", config.StateFile, unmarshalErr)
+	}
+	return saved
+}
+
+// resumeJobs requests the saved transcodes from the server listening on
+// addr, one after the other, discarding the responses: the transcodes
+// end up in the cache. The StateFile is removed once all of them are
+// done, so that those cut short by another restart are resumed again.
+func resumeJobs(addr string, saved []savedJob) {
+	host, port, _ := net.SplitHostPort(addr)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	base := "http://" + net.JoinHostPort(host, port) + config.PathPrefix
+	client := &http.Client{}
+	for _, job := range saved {
+		resumeReq, reqErr := http.NewRequest("GET", base+job.URI, nil)
+		if reqErr != nil {
+			log.Printf("Error resuming %s: %v", job.URI, reqErr)
+			continue
+		}
+		if job.Namespace != "" {
+			resumeReq.Header.Set("X-Tenant", job.Namespace)
+		}
+		resp, respErr := client.Do(resumeReq)
+		if respErr != nil {
+			log.Printf("Error resuming %s: %v", job.URI, respErr)
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("Error resuming %s: %s", job.URI, resp.Status)
+			continue
+		}
+		log.Printf("Resumed %s", job.URI)
+	}
+	removeErr := os.Remove(config.StateFile)
+	if removeErr != nil && os.IsNotExist(removeErr) == false {
+		log.Printf("Error removing %s: %v", config.StateFile, removeErr)
+	}
+}
+
+// transcodeCounters are the counters kept overall and for each width.
+// They are only ever updated atomically, so that the request path never
+// waits on a lock for them.
+type transcodeCounters struct {
+	requests        int64
+	bytesServed     int64
+	cacheHits       int64
+	cacheMisses     int64
+	transcodes      int64
+	transcodeNanos  int64
+	bytesTranscoded int64
+}
+
+// countersSnapshot is a transcodeCounters in the GET /admin/stats
+// response.
+type countersSnapshot struct {
+	Requests                int64   `json:"requests"`
+	BytesServed             int64   `json:"bytesServed"`
+	CacheHits               int64   `json:"cacheHits"`
+	CacheMisses             int64   `json:"cacheMisses"`
+	CacheHitRatio           float64 `json:"cacheHitRatio"`
+	Transcodes              int64   `json:"transcodes"`
+	AverageTranscodeSeconds float64 `json:"averageTranscodeSeconds"`
+	BytesTranscoded         int64   `json:"bytesTranscoded"`
+}
+
+func (c *transcodeCounters) snapshot() countersSnapshot {
+	snapshot := countersSnapshot{
+		Requests:        atomic.LoadInt64(&c.requests),
+		BytesServed:     atomic.LoadInt64(&c.bytesServed),
+		CacheHits:       atomic.LoadInt64(&c.cacheHits),
+		CacheMisses:     atomic.LoadInt64(&c.cacheMisses),
+		Transcodes:      atomic.LoadInt64(&c.transcodes),
+		BytesTranscoded: atomic.LoadInt64(&c.bytesTranscoded),
+	}
+	if snapshot.CacheHits+snapshot.CacheMisses > 0 {
+		snapshot.CacheHitRatio = float64(snapshot.CacheHits) / float64(snapshot.CacheHits+snapshot.CacheMisses)
+	}
+	if snapshot.Transcodes > 0 {
+		snapshot.AverageTranscodeSeconds = time.Duration(atomic.LoadInt64(&c.transcodeNanos)).Seconds() / float64(snapshot.Transcodes)
+	}
+	return snapshot
+}
+
+// statsSnapshot is the GET /admin/stats response.
+type statsSnapshot struct {
+	countersSnapshot
+	UptimeSeconds      float64                     `json:"uptimeSeconds"`
+	QueueLength        int                         `json:"queueLength"`
+	QueueRejected      int64                       `json:"queueRejected"`
+	SlowTranscodes     int64                       `json:"slowTranscodes"`
+	EncoderUnavailable int64                       `json:"encoderUnavailable"`
+	HardwareFallbacks  int64                       `json:"hardwareFallbacks"`
+	Widths             map[string]countersSnapshot `json:"widths"`
+}
+
+// serverStats holds the counters overall and for each of the Widths. The
+// widths map is filled in once at startup and only read afterwards.
+type serverStats struct {
+	started time.Time
+	total   transcodeCounters
+	widths  map[int]*transcodeCounters
+}
+
+func newServerStats(widths []int) *serverStats {
+	s := &serverStats{started: time.Now(), widths: make(map[int]*transcodeCounters)}
+	for _, width := range widths {
+		s.widths[width] = &transcodeCounters{}
+	}
+	return s
+}
+
+// counters returns the counters a request for width adds to: the overall
+// ones and those of the width.
+func (s *serverStats) counters(width int) []*transcodeCounters {
+	counters := []*transcodeCounters{&s.total}
+	if widthCounters, found := s.widths[width]; found {
+		counters = append(counters, widthCounters)
+	}
+	return counters
+}
+
+func (s *serverStats) cacheHit(counters []*transcodeCounters) {
+	for _, c := range counters {
+		atomic.AddInt64(&c.cacheHits, 1)
+	}
+}
+
+// transcoded records a completed transcode that took duration and
+// produced size bytes.
+func (s *serverStats) transcoded(counters []*transcodeCounters, duration time.Duration, size int64) {
+	for _, c := range counters {
+		atomic.AddInt64(&c.transcodes, 1)
+		atomic.AddInt64(&c.transcodeNanos, int64(duration))
+		atomic.AddInt64(&c.bytesTranscoded, size)
+	}
+}
+
+func (s *serverStats) snapshot() statsSnapshot {
+	snapshot := statsSnapshot{
+		countersSnapshot:   s.total.snapshot(),
+		UptimeSeconds:      time.Since(s.started).Seconds(),
+		QueueLength:        queue.length(),
+		QueueRejected:      atomic.LoadInt64(&queueRejected),
+		SlowTranscodes:     atomic.LoadInt64(&slowTranscodes),
+		EncoderUnavailable: atomic.LoadInt64(&encoderUnavailable),
+		HardwareFallbacks:  atomic.LoadInt64(&hardwareFallbacks),
+		Widths:             make(map[string]countersSnapshot),
+	}
+	for width, counters := range s.widths {
+		snapshot.Widths[strconv.Itoa(width)] = counters.snapshot()
+	}
+	return snapshot
+}
+
+// countingWriter adds the bytes written to a response to the bytesServed
+// of its counters.
+type countingWriter struct {
+	http.ResponseWriter
+	counters []*transcodeCounters
+}
+
+func (rw *countingWriter) count(n int64) {
+	for _, c := range rw.counters {
+		atomic.AddInt64(&c.bytesServed, n)
+	}
+}
+
+func (rw *countingWriter) Write(data []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(data)
+	rw.count(int64(n))
+	return n, err
+}
+
+func (rw *countingWriter) Flush() {
+	flusher, ok := rw.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// ReadFrom keeps the underlying ResponseWriter's sendfile support for
+// http.ServeFile.
+func (rw *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(rw.ResponseWriter, src)
+	rw.count(n)
+	return n, err
+}
+
+// growingFile is a cache file being written by a transcode.
+type growingFile struct {
+	name string
+	// done is closed once the transcode has finished, failed is set
+	// before that when it didn't complete.
+	done   chan struct{}
+	failed bool
+}
+
+// growingRegistry tracks the growingFiles by the cache file they will be
+// renamed to.
+type growingRegistry struct {
+	mu    sync.Mutex
+	files map[string]*growingFile
+}
+
+func newGrowingRegistry() *growingRegistry {
+	return &growingRegistry{files: make(map[string]*growingFile)}
+}
+
+func (r *growingRegistry) add(key string, name string) *growingFile {
+	file := &growingFile{name: name, done: make(chan struct{})}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A transcode already writing key keeps serving its own readers,
+	// later readers go to the newest one.
+	r.files[key] = file
+	return file
+}
+
+func (r *growingRegistry) get(key string) *growingFile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.files[key]
+}
+
+// finish marks file as done and wakes up its readers.
+func (r *growingRegistry) finish(key string, file *growingFile, completed bool) {
+	r.mu.Lock()
+	if r.files[key] == file {
+		delete(r.files, key)
+	}
+	r.mu.Unlock()
+	file.failed = completed == false
+	close(file.done)
+}
+
+// errTranscodeFailed is returned by a TailingReader whose transcode
+// didn't complete.
+var errTranscodeFailed = errors.New("transcode failed")
+
+// TailingReader reads a file while it is being written, waiting at EOF
+// for more data until the writer is done.
+type TailingReader struct {
+	file   *os.File
+	source *growingFile
+	ctx    context.Context
+}
+
+func (tr *TailingReader) Read(data []byte) (int, error) {
+	for {
+		count, readErr := tr.file.Read(data)
+		if count > 0 || readErr != io.EOF {
+			return count, readErr
+		}
+		select {
+		case <-tr.source.done:
+			// Whatever was written between the read and the writer
+			// finishing is still to be read.
+			count, readErr = tr.file.Read(data)
+			if count > 0 || readErr != io.EOF {
+				return count, readErr
+			}
+			if tr.source.failed {
+				return 0, errTranscodeFailed
+			}
+			return 0, io.EOF
+		case <-tr.ctx.Done():
+			return 0, tr.ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// encodeTwoPass runs a two-pass encode of inputFile into outputFile and
+// waits for it to finish. The pass log lives in a temporary directory
+// that is removed afterwards.
+func encodeTwoPass(ctx context.Context, inputFile string, opts TranscodeOptions, outputFile string) error {
+	passDir, passDirErr := ioutil.TempDir("", "vse-pass")
+	if passDirErr != nil {
+		return passDirErr
+	}
+	defer os.RemoveAll(passDir)
+	passLog := path.Join(passDir, "ffmpeg2pass")
+	scale := opts.videoFilter(inputFile)
+
+	pass1Args := append([]string{"-y"}, decodeArgs(inputFile)...)
+	pass1Args = append(pass1Args,
+		"-filter_complex", opts.videoInput()+scale+"[out1]", "-map", "[out1]",
+	)
+	pass1Args = append(pass1Args, opts.codecArgs()...)
+	pass1Args = append(pass1Args, "-b:v", opts.Bitrate)
+	if opts.Tune != "" {
+		pass1Args = append(pass1Args, "-tune", opts.Tune)
+	}
+	pass1Args = append(pass1Args, opts.passArgs(1, passLog)...)
+	pass1Args = append(pass1Args, "-an", "-f", "null", os.DevNull)
+	pass1 := newCommand(ctx, "ffmpeg", pass1Args...)
+	defer logFFmpeg(pass1, opts.LogName, pass1Args)()
+	pass1Err := runFFmpeg(pass1)
+	if pass1Err != nil {
+		return pass1Err
+	}
+
+	filter := opts.videoInput() + scale + "[out1]"
+	audio := opts.audioArgs("")
+	if opts.Loudnorm {
+		filter += fmt.Sprintf(";[0:a]%s[aout1]", loudnormFilter)
+		audio = opts.audioArgs("[aout1]")
+	}
+	args := append([]string{"-y"}, decodeArgs(inputFile)...)
+	args = append(args, "-filter_complex", filter, "-map", "[out1]")
+	args = append(args, audio...)
+	args = append(args, opts.passArgs(2, passLog)...)
+	args = append(args, opts.outputArgs()...)
+	args = append(args, opts.fileArgs()...)
+	args = append(args, outputFile)
+	pass2 := newCommand(ctx, "ffmpeg", args...)
+	defer logFFmpeg(pass2, opts.LogName, args)()
+	return runFFmpeg(pass2)
+}
+
+// spriteOptions describe a sprite sheet: Columns x Rows thumbnails of
+// Width pixels, one every Interval seconds.
+type spriteOptions struct {
+	Interval int
+	Columns  int
+	Rows     int
+	Width    int
+	// Accurate takes each thumbnail at its exact time by decoding the
+	// whole input, rather than seeking to the nearest keyframe.
+	Accurate bool
+}
+
+// parseSpriteOptions reads the interval, cols and rows query parameters,
+// falling back to the config and then to a 5x5 grid of 160px thumbnails
+// every 10 seconds. It returns an error message for invalid values.
+func parseSpriteOptions(query url.Values) (spriteOptions, string) {
+	sopts := spriteOptions{
+		Interval: config.SpriteInterval,
+		Columns:  config.SpriteColumns,
+		Rows:     config.SpriteRows,
+		Width:    config.SpriteWidth,
+	}
+	if sopts.Interval == 0 {
+		sopts.Interval = 10
+	}
+	if sopts.Columns == 0 {
+		sopts.Columns = 5
+	}
+	if sopts.Rows == 0 {
+		sopts.Rows = 5
+	}
+	if sopts.Width == 0 {
+		sopts.Width = 160
+	}
+	params := []struct {
+		name  string
+		value *int
+		max   int
+	}{
+		{"interval", &sopts.Interval, 3600},
+		{"cols", &sopts.Columns, 20},
+		{"rows", &sopts.Rows, 20},
+	}
+	for _, param := range params {
+		raw := query.Get(param.name)
+		if raw == "" {
+			continue
+		}
+		val, valErr := strconv.Atoi(raw)
+		if valErr != nil || val < 1 || val > param.max {
+			return sopts, "Invalid " + param.name
+		}
+		*param.value = val
+	}
+	accurate := query.Get("accurate")
+	if accurate != "" {
+		accurateVal, accurateErr := strconv.ParseBool(accurate)
+		if accurateErr != nil {
+			return sopts, "Invalid accurate"
+		}
+		sopts.Accurate = accurateVal
+	}
+	return sopts, ""
+}
+
+// generateSprite writes spriteBase.jpg and spriteBase.vtt for inputFile.
+// The sheet has room for Columns x Rows thumbnails, so the interval is
+// stretched for videos too long to fit in it at the requested one.
+// sheetName is the URL of the sheet relative to the WebVTT file, and
+// logName the FFmpegLogDir log of ffmpeg.
+func generateSprite(ctx context.Context, inputFile string, sopts spriteOptions, spriteBase string, sheetName string, logName string) error {
+	probe, probeErr := probeFile(ctx, inputFile)
+	if probeErr != nil {
+		return probeErr
+	}
+	video := probe.videoStream()
+	if video == nil || video.Width == 0 || video.Height == 0 {
+		return fmt.Errorf("no video stream")
+	}
+	duration := probe.duration()
+	interval := float64(sopts.Interval)
+	tiles := sopts.Columns * sopts.Rows
+	if duration > interval*float64(tiles) {
+		interval = duration / float64(tiles)
+	}
+	// The thumbnails are turned upright.
+	sourceWidth, sourceHeight := video.displaySize()
+	height := sopts.Width * sourceHeight / sourceWidth
+	height += height % 2
+	count := 0
+	for count < tiles && float64(count)*interval < duration {
+		count++
+	}
+
+	dirErr := os.MkdirAll(path.Dir(spriteBase), os.ModePerm)
+	if dirErr != nil {
+		return dirErr
+	}
+	tempFile, tempFileErr := ioutil.TempFile(path.Dir(spriteBase), path.Base(spriteBase))
+	if tempFileErr != nil {
+		return tempFileErr
+	}
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	args := []string{"-y"}
+	if sopts.Accurate == false {
+		// Only the keyframes are decoded, the rest of the input is merely
+		// read through, and the fps filter below takes the keyframe
+		// nearest to each thumbnail. Seeking to each of them instead
+		// would take an input per thumbnail, hundreds of them for the
+		// largest sheets.
+		args = append(args, "-skip_frame", "nokey")
+	}
+	// The fps filter picks the frames, which when accurate means decoding
+	// the whole input to get to them.
+	args = append(args, inputArgs(inputFile)...)
+	args = append(args, "-vf", fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d", interval, sopts.Width, height, sopts.Columns, sopts.Rows))
+	args = append(args, "-frames:v", "1", "-q:v", "5", "-update", "1", "-f", "image2", tempFile.Name())
+	cmd := newCommand(ctx, "ffmpeg", args...)
+	defer logFFmpeg(cmd, logName, args)()
+	runErr := runFFmpeg(cmd)
+	if runErr != nil {
+		return runErr
+	}
+
+	var vtt bytes.Buffer
+	vtt.WriteString("WEBVTT\n")
+	for ii := 0; ii < count; ii++ {
+		end := math.Min(float64(ii+1)*interval, duration)
+		fmt.Fprintf(&vtt, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(float64(ii)*interval), vttTimestamp(end), sheetName,
+			(ii%sopts.Columns)*sopts.Width, (ii/sopts.Columns)*height, sopts.Width, height)
+	}
+	writeErr := ioutil.WriteFile(tempFile.Name()+".vtt", vtt.Bytes(), 0644)
+	if writeErr != nil {
+		return writeErr
+	}
+	defer os.Remove(tempFile.Name() + ".vtt")
+	renameErr := os.Rename(tempFile.Name(), spriteBase+".jpg")
+	if renameErr != nil {
+		return renameErr
+	}
+	return os.Rename(tempFile.Name()+".vtt", spriteBase+".vtt")
+}
+
+// vttTimestamp formats seconds as a WebVTT timestamp.
+func vttTimestamp(seconds float64) string {
+	millis := int64(seconds * 1000)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
+
+// previewOptions describe a hover preview: Duration seconds of video
+// from Start, Width pixels wide.
+type previewOptions struct {
+	Start    float64
+	Duration float64
+	Width    int
+}
+
+// maxPreviewDuration is the longest preview that can be asked for, in
+// seconds.
+const maxPreviewDuration = 10
+
+// parsePreviewOptions reads the t (start) and d (duration) query
+// parameters, in seconds with an optional "s" suffix, defaulting to 3
+// seconds from the start. It returns an error message for invalid values.
+func parsePreviewOptions(query url.Values) (previewOptions, string) {
+	popts := previewOptions{Duration: 3, Width: config.PreviewWidth}
+	if popts.Width == 0 {
+		popts.Width = 320
+	}
+	if query.Get("t") != "" {
+		start, startErr := strconv.ParseFloat(strings.TrimSuffix(query.Get("t"), "s"), 64)
+		if startErr != nil || start < 0 || math.IsInf(start, 0) {
+			return popts, "Invalid t"
+		}
+		popts.Start = start
+	}
+	if query.Get("d") != "" {
+		duration, durationErr := strconv.ParseFloat(strings.TrimSuffix(query.Get("d"), "s"), 64)
+		if durationErr != nil || duration <= 0 || duration > maxPreviewDuration {
+			return popts, "Invalid d"
+		}
+		popts.Duration = duration
+	}
+	return popts, ""
+}
+
+// generateStill writes the first frame of inputFile to stillName as a
+// JPEG, filtered as the video would be.
+func generateStill(ctx context.Context, inputFile string, opts TranscodeOptions, stillName string) error {
+	dirErr := os.MkdirAll(path.Dir(stillName), os.ModePerm)
+	if dirErr != nil {
+		return dirErr
+	}
+	tempFile, tempFileErr := ioutil.TempFile(path.Dir(stillName), path.Base(stillName))
+	if tempFileErr != nil {
+		return tempFileErr
+	}
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	args := append([]string{"-y"}, decodeArgs(inputFile)...)
+	args = append(args,
+		"-vf", opts.videoFilter(inputFile), "-frames:v", "1", "-an",
+		"-c:v", "mjpeg", "-q:v", "3", "-f", "image2", tempFile.Name(),
+	)
+	cmd := newCommand(ctx, "ffmpeg", args...)
+	defer logFFmpeg(cmd, opts.LogName, args)()
+	runErr := runFFmpeg(cmd)
+	if runErr != nil {
+		return runErr
+	}
+	return os.Rename(tempFile.Name(), stillName)
+}
+
+// pipOptions describe a picture-in-picture output: Width pixels wide,
+// with the overlay Scale times as wide in the Position corner, one of
+// pipPositions.
+type pipOptions struct {
+	Width    int
+	Position string
+	Scale    float64
+}
+
+// pipPositions are the overlay filter coordinates of each corner, leaving
+// a margin of 2% of the width.
+var pipPositions = map[string]string{
+	"tl": "W/50:W/50",
+	"tr": "W-w-W/50:W/50",
+	"bl": "W/50:H-h-W/50",
+	"br": "W-w-W/50:H-h-W/50",
+}
+
+// parsePipOptions reads the ?width=, ?pos= and ?scale= of a /pip/ URL,
+// defaulting to the DefaultWidth and a quarter-width overlay in the
+// bottom right corner.
+func parsePipOptions(query url.Values) (pipOptions, string) {
+	pipts := pipOptions{Width: config.DefaultWidth, Position: "br", Scale: 0.25}
+	if query.Get("width") != "" {
+		width, widthErr := strconv.Atoi(strings.TrimSuffix(query.Get("width"), "p"))
+		if widthErr != nil {
+			return pipts, "Invalid width"
+		}
+		pipts.Width = 0
+		for _, ii := range config.Widths {
+			if ii == width {
+				pipts.Width = width
+			}
+		}
+	}
+	if pipts.Width == 0 {
+		return pipts, "Invalid width"
+	}
+	if query.Get("pos") != "" {
+		if _, found := pipPositions[query.Get("pos")]; found == false {
+			return pipts, "Invalid pos"
+		}
+		pipts.Position = query.Get("pos")
+	}
+	if query.Get("scale") != "" {
+		scale, scaleErr := strconv.ParseFloat(query.Get("scale"), 64)
+		if scaleErr != nil || scale <= 0 || scale >= 1 {
+			return pipts, "Invalid scale"
+		}
+		pipts.Scale = scale
+	}
+	return pipts, ""
+}
+
+// cacheFile is where the output of mainName with overlayName is cached,
+// named after the main video and a hash of everything else.
+func (pipts pipOptions) cacheFile(mainName string, overlayName string) string {
+	params := url.Values{}
+	params.Set("overlay", overlayName)
+	params.Set("width", strconv.Itoa(pipts.Width))
+	params.Set("pos", pipts.Position)
+	params.Set("scale", strconv.FormatFloat(pipts.Scale, 'f', -1, 64))
+	if config.CacheVersion != "" {
+		params.Set("version", config.CacheVersion)
+	}
+	sum := sha256.Sum256([]byte(params.Encode()))
+	return path.Join(config.OutputDir, "pip", mainName) + "." + hex.EncodeToString(sum[:8]) + ".mp4"
+}
+
+// generatePip writes mainFile with overlayFile composited onto it to
+// pipFile. The output lasts as long as the main video, whose audio it
+// keeps, and the overlay disappears when it ends. ffmpeg logs to the
+// FFmpegLogDir log logName.
+func generatePip(ctx context.Context, mainFile string, overlayFile string, pipts pipOptions, pipFile string, logName string) error {
+	dirErr := os.MkdirAll(path.Dir(pipFile), os.ModePerm)
+	if dirErr != nil {
+		return dirErr
+	}
+	tempFile, tempFileErr := ioutil.TempFile(path.Dir(pipFile), path.Base(pipFile))
+	if tempFileErr != nil {
+		return tempFileErr
+	}
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	overlayWidth := int(float64(pipts.Width)*pipts.Scale) / 2 * 2
+	filter := fmt.Sprintf("[0:v]scale=%d:-2[main];[1:v]scale=%d:-2[pip];[main][pip]overlay=%s:eof_action=pass,format=yuv420p[out]",
+		pipts.Width, overlayWidth, pipPositions[pipts.Position])
+	opts := TranscodeOptions{Width: pipts.Width, Codec: "h264"}
+	if config.Codec != "" {
+		opts.Codec = config.Codec
+	}
+	args := append([]string{"-y"}, decodeArgs(mainFile)...)
+	args = append(args, decodeArgs(overlayFile)...)
+	args = append(args, "-filter_complex", filter, "-map", "[out]", "-map", "0:a?", "-c:a", "copy")
+	args = append(args, opts.codecArgs()...)
+	args = append(args, "-movflags", "+faststart", "-f", "mp4", tempFile.Name())
+	cmd := newCommand(ctx, "ffmpeg", args...)
+	defer logFFmpeg(cmd, logName, args)()
+	runErr := runFFmpeg(cmd)
+	if runErr != nil {
+		return runErr
+	}
+	return os.Rename(tempFile.Name(), pipFile)
+}
+
+// errPreviewRange is returned by generatePreview for previews starting
+// past the end of the video.
+var errPreviewRange = errors.New("preview starts after the end of the video")
+
+// generatePreview writes the preview of inputFile to previewFile, an
+// animated WebP or a muted MP4 depending on its extension. Previews
+// running past the end of the video are cut short. ffmpeg logs to the
+// FFmpegLogDir log logName.
+func generatePreview(ctx context.Context, inputFile string, popts previewOptions, previewFile string, logName string) error {
+	probe, probeErr := probeFile(ctx, inputFile)
+	if probeErr != nil {
+		return probeErr
+	}
+	if probe.videoStream() == nil {
+		return fmt.Errorf("no video stream")
+	}
+	duration := probe.duration()
+	if duration > 0 && popts.Start >= duration {
+		return errPreviewRange
+	}
+	dirErr := os.MkdirAll(path.Dir(previewFile), os.ModePerm)
+	if dirErr != nil {
+		return dirErr
+	}
+	tempFile, tempFileErr := ioutil.TempFile(path.Dir(previewFile), path.Base(previewFile))
+	if tempFileErr != nil {
+		return tempFileErr
+	}
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	// Seeking ahead of -i jumps to the nearest keyframe rather than
+	// decoding the video up to the start.
+	args := []string{"-y", "-ss", fmt.Sprintf("%g", popts.Start), "-t", fmt.Sprintf("%g", popts.Duration)}
+	args = append(args, inputArgs(inputFile)...)
+	if path.Ext(previewFile) == ".webp" {
+		args = append(args,
+			"-vf", fmt.Sprintf("fps=12,scale=%d:-2", popts.Width), "-an",
+			"-c:v", "libwebp", "-loop", "0", "-q:v", "60", "-f", "webp",
+		)
+	} else {
+		args = append(args,
+			"-vf", fmt.Sprintf("scale=%d:-2", popts.Width), "-an",
+			"-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "+faststart", "-f", "mp4",
+		)
+	}
+	args = append(args, tempFile.Name())
+	cmd := newCommand(ctx, "ffmpeg", args...)
+	defer logFFmpeg(cmd, logName, args)()
+	runErr := runFFmpeg(cmd)
+	if runErr != nil {
+		return runErr
+	}
+	return os.Rename(tempFile.Name(), previewFile)
+}
+
+// probeResult is the part of ffprobe's JSON output we use.
+type probeResult struct {
+	Streams []probeStream `json:"streams"`
+	Format  struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+type probeStream struct {
+	Index        int    `json:"index"`
+	CodecType    string `json:"codec_type"`
+	CodecName    string `json:"codec_name"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	AvgFrameRate string `json:"avg_frame_rate"`
+	RFrameRate   string `json:"r_frame_rate"`
+	Channels     int    `json:"channels"`
+	NbFrames     string `json:"nb_frames"`
+	// ColorTransfer is the transfer characteristic, e.g. "smpte2084".
+	ColorTransfer string `json:"color_transfer"`
+	// ColorPrimaries and ColorSpace are the other color tags, e.g.
+	// "bt709".
+	ColorPrimaries string `json:"color_primaries"`
+	ColorSpace     string `json:"color_space"`
+	Tags           struct {
+		Rotate string `json:"rotate"`
+	} `json:"tags"`
+	SideDataList []struct {
+		Rotation float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// rotation returns the clockwise rotation of the stream in degrees, 0,
+// 90, 180 or 270. Older ffmpeg versions report it as a rotate tag, newer
+// ones as a display matrix rotated the other way.
+func (stream *probeStream) rotation() int {
+	degrees := 0
+	if stream.Tags.Rotate != "" {
+		degrees, _ = strconv.Atoi(stream.Tags.Rotate)
+	}
+	for _, sideData := range stream.SideDataList {
+		if sideData.Rotation != 0 {
+			degrees = -int(math.Round(sideData.Rotation))
+		}
+	}
+	degrees = (degrees%360 + 360) % 360
+	return degrees / 90 * 90
+}
+
+// displaySize returns the width and height of the stream once turned
+// upright: sources rotated by 90 or 270 degrees are as tall as they are
+// wide.
+func (stream *probeStream) displaySize() (int, int) {
+	if stream.rotation()%180 != 0 {
+		return stream.Height, stream.Width
+	}
+	return stream.Width, stream.Height
+}
+
+// hdr reports whether the stream is HDR10 (PQ) or HLG.
+func (stream *probeStream) hdr() bool {
+	return stream.ColorTransfer == "smpte2084" || stream.ColorTransfer == "arib-std-b67"
+}
+
+// probeFile runs ffprobe on inputFile.
+func probeFile(ctx context.Context, inputFile string) (*probeResult, error) {
+	args := []string{"-v", "error", "-print_format", "json", "-show_format", "-show_streams"}
+	args = append(args, inputArgs(inputFile)...)
+	out, probeErr := newCommand(ctx, "ffprobe", args...).Output()
+	if probeErr != nil {
+		return nil, checkEncoderErr(probeErr)
+	}
+	return parseProbe(out)
+}
+
+// parseProbe parses the JSON output of ffprobe.
+func parseProbe(out []byte) (*probeResult, error) {
+	var probe probeResult
+	unmarshalErr := json.Unmarshal(out, &probe)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	return &probe, nil
+}
+
+// videoStream returns the first video stream, or nil for audio-only
+// inputs.
+func (probe *probeResult) videoStream() *probeStream {
+	for ii := range probe.Streams {
+		if probe.Streams[ii].CodecType == "video" {
+			return &probe.Streams[ii]
+		}
+	}
+	return nil
+}
+
+// subtitleStreams returns the subtitle streams, in order.
+func (probe *probeResult) subtitleStreams() []probeStream {
+	var subtitles []probeStream
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "subtitle" {
+			subtitles = append(subtitles, stream)
+		}
+	}
+	return subtitles
+}
+
+// imageSubtitleCodecs are the bitmap subtitle formats, which the
+// subtitles filter can't render.
+var imageSubtitleCodecs = []string{"dvd_subtitle", "dvb_subtitle", "hdmv_pgs_subtitle", "xsub"}
+
+// videoStreams returns the number of video streams.
+func (probe *probeResult) videoStreams() int {
+	count := 0
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" {
+			count++
+		}
+	}
+	return count
+}
+
+// duration returns the length of the input in seconds, or zero if it
+// isn't known.
+func (probe *probeResult) duration() float64 {
+	duration, parseErr := strconv.ParseFloat(probe.Format.Duration, 64)
+	if parseErr != nil {
+		return 0
+	}
+	return duration
+}
+
+// audioChannels returns the channel count of the first audio stream, or
+// zero for silent inputs.
+func (probe *probeResult) audioChannels() int {
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "audio" {
+			return stream.Channels
+		}
+	}
+	return 0
+}
+
+// frameRate returns the average frame rate of the first video stream, or
+// zero if it isn't known.
+func (probe *probeResult) frameRate() float64 {
+	video := probe.videoStream()
+	if video == nil {
+		return 0
+	}
+	return parseRate(video.AvgFrameRate)
+}
+
+// shortClipDuration is the length in seconds under which a clip is
+// encoded as a ShortClip.
+const shortClipDuration = 1.0
+
+// singleFrame reports whether the first video stream is a single frame,
+// going by its frame count or, when the container doesn't have one, by
+// its duration.
+func (probe *probeResult) singleFrame() bool {
+	video := probe.videoStream()
+	if video == nil {
+		return false
 	}
-	urlRegex, regexpErr := regexp.Compile("/(?P<width>\\d+)p/(?P<filename>.*?)$")
-	if regexpErr != nil {
-		log.Fatal("Invalid regexp")
+	frames, parseErr := strconv.Atoi(video.NbFrames)
+	if parseErr == nil && frames > 0 {
+		return frames == 1
 	}
-	http.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
-		reqPath := req.URL.Path
-		matches := urlRegex.MatchString(reqPath)
-		flusher, ok := rw.(http.Flusher)
+	rate := probe.frameRate()
+	return rate > 0 && probe.duration() > 0 && probe.duration()*rate < 1.5
+}
+
+// variableFrameRate reports whether the first video stream looks like it
+// has a variable frame rate: ffprobe then finds a base rate (the lowest
+// one all timestamps fit) that differs from the average.
+func (probe *probeResult) variableFrameRate() bool {
+	video := probe.videoStream()
+	if video == nil {
+		return false
+	}
+	base := parseRate(video.RFrameRate)
+	average := parseRate(video.AvgFrameRate)
+	if base == 0 || average == 0 {
+		return false
+	}
+	return math.Abs(base-average)/base > 0.01
+}
+
+// parseRate parses a frame rate such as "30000/1001" as ffprobe reports
+// them, returning zero if it isn't known.
+func parseRate(rate string) float64 {
+	var num, den float64
+	_, scanErr := fmt.Sscanf(rate, "%g/%g", &num, &den)
+	if scanErr != nil || den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// decodeArgs are the ffmpeg options opening inputFile for a transcode.
+// ffmpeg turns rotated frames upright on its own unless told otherwise.
+func decodeArgs(inputFile string) []string {
+	args := append([]string{}, config.FFmpegInputArgs...)
+	if config.KeepRotation {
+		args = append(args, "-noautorotate")
+	}
+	return append(args, inputArgs(inputFile)...)
+}
+
+// checkFFmpegArgs returns the first of args that isn't one of flags or
+// the value of the flag before it, or "" if they are all allowed.
+func checkFFmpegArgs(args []string, flags map[string]bool) string {
+	for ii := 0; ii < len(args); ii++ {
+		takesValue, ok := flags[args[ii]]
 		if ok != true {
-			rw.WriteHeader(http.StatusBadRequest)
-			rw.Write([]byte("Invalid Flusher"))
-		}
-		if matches == true {
-			ret := urlRegex.FindStringSubmatch(reqPath)
-			width, widthConvErr := strconv.Atoi(ret[1])
-			if widthConvErr != nil {
-				rw.WriteHeader(http.StatusBadRequest)
-				rw.Write([]byte("Invalid Width"))
-				return
-			}
-			found := false
-			for _, ii := range config.Widths {
-				if ii == width {
-					found = true
-				}
-			}
-			if found == false {
-				rw.WriteHeader(http.StatusBadRequest)
-				rw.Write([]byte("Invalid Width"))
-				return
+			return args[ii]
+		}
+		if takesValue {
+			if ii+1 == len(args) {
+				return args[ii]
 			}
-			outputDir := fmt.Sprintf("%s/%d", config.OutputDir, width)
-			dirErr := os.MkdirAll(outputDir, os.ModePerm)
-			if dirErr != nil {
-				rw.WriteHeader(http.StatusBadRequest)
-				rw.Write([]byte("Could not create temporary directory"))
-				return
+			ii++
+		}
+	}
+	return ""
+}
+
+// inputArgs are the ffmpeg and ffprobe options opening inputFile.
+func inputArgs(inputFile string) []string {
+	var args []string
+	format, ok := config.InputFormats[strings.ToLower(strings.TrimPrefix(path.Ext(inputFile), "."))]
+	if ok {
+		args = append(args, "-f", format)
+	}
+	if config.ProbeSize > 0 {
+		args = append(args, "-probesize", strconv.FormatInt(config.ProbeSize, 10))
+	}
+	if config.AnalyzeDuration.Duration > 0 {
+		// -analyzeduration is in microseconds.
+		args = append(args, "-analyzeduration", strconv.FormatInt(int64(config.AnalyzeDuration.Duration/time.Microsecond), 10))
+	}
+	return append(args, "-i", inputFile)
+}
+
+// slowProgressWarmup is how much video is encoded before the speed is
+// checked against the SlowTranscodeRatio, as ffmpeg starts slowly.
+const slowProgressWarmup = 10 * time.Second
+
+// watchProgress reads the -progress output of the transcode of inputFile,
+// logging a warning the first time its speed drops below the
+// SlowTranscodeRatio.
+func watchProgress(progress io.ReadCloser, inputFile string) {
+	defer progress.Close()
+	scanner := bufio.NewScanner(progress)
+	var outTime time.Duration
+	for scanner.Scan() {
+		pair := strings.SplitN(scanner.Text(), "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		switch pair[0] {
+		case "out_time_us":
+			micros, parseErr := strconv.ParseInt(pair[1], 10, 64)
+			if parseErr == nil {
+				outTime = time.Duration(micros) * time.Microsecond
 			}
-			filename := ret[2]
-			origFile, origFileErr := os.Open(fmt.Sprintf("%s/%s", config.InputDir, filename))
-			defer origFile.Close()
-			if origFileErr != nil {
-				rw.WriteHeader(http.StatusNotFound)
-				rw.Write([]byte("Not Found"))
+		case "speed":
+			// e.g. "0.53x", or "N/A" at the start.
+			speed, parseErr := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(pair[1]), "x"), 64)
+			if parseErr == nil && outTime >= slowProgressWarmup && speed < config.SlowTranscodeRatio {
+				atomic.AddInt64(&slowTranscodes, 1)
+				log.Printf("Slow transcode of %s: %.2fx, below %.2fx", inputFile, speed, config.SlowTranscodeRatio)
+				// Keep draining the pipe so that ffmpeg doesn't block on
+				// it.
+				io.Copy(ioutil.Discard, progress)
 				return
-			} else {
-				trFileName := fmt.Sprintf("%s/%s", outputDir, filename)
-				_, trFileErr := os.Stat(trFileName)
-				if trFileErr == nil {
-					http.ServeFile(rw, req, trFileName)
-				} else {
-					tempFile, tempFileErr := ioutil.TempFile(
-						outputDir,
-						path.Base(origFile.Name()))
-					defer tempFile.Close()
-					if tempFileErr != nil {
-						rw.WriteHeader(http.StatusBadRequest)
-						rw.Write([]byte("Could not create temporary file"))
-						return
-					}
-					ctx := req.Context()
-					rw.Header().Set("Transfer-Encoding", "chunked")
-					tret := transcodeFile(origFile.Name(), width, tempFile.Name())
-					cmd := tret.cmd
-					defer cmd.Process.Kill()
-					defer cmd.Process.Wait()
-					rc := *(tret.rc)
-					defer rc.Close()
-					done := 0
-					for {
-						_, err := io.CopyN(rw, rc, 16*1024)
-						if err != nil {
-							done = 1
-							if err == io.EOF {
-								os.Rename(tempFile.Name(), trFileName)
-								break
-							}
-							break
-						}
-						select {
-						case <-ctx.Done():
-							done = 1
-							break
-						default:
-							break
-						}
-						if done == 1 {
-							os.Remove(tempFile.Name())
-							break
-						}
-						flusher.Flush()
-					}
-				}
 			}
-		} else {
-			rw.WriteHeader(http.StatusNotFound)
-			rw.Write([]byte("Not Found"))
-			return
 		}
-	})
+	}
+}
+
+// newCommand creates every ffmpeg and ffprobe command. It is a variable
+// so that a fake encoder, such as a script writing canned output, can be
+// swapped in to exercise the handlers without a real ffmpeg.
+var newCommand = exec.CommandContext
+
+// errEncoderUnavailable wraps the errors of ffmpeg or ffprobe failing to
+// start because their binary has gone missing.
+var errEncoderUnavailable = errors.New("encoder unavailable")
+
+// checkEncoderErr wraps startErr, the error starting ffmpeg or ffprobe,
+// in errEncoderUnavailable when it is down to a missing binary.
+func checkEncoderErr(startErr error) error {
+	if errors.Is(startErr, exec.ErrNotFound) || errors.Is(startErr, os.ErrNotExist) {
+		atomic.AddInt64(&encoderUnavailable, 1)
+		log.Printf("Encoder unavailable: %s", startErr)
+		return fmt.Errorf("%w: %s", errEncoderUnavailable, startErr)
+	}
+	return startErr
+}
+
+// ffmpegVersion returns a short hash of the first line of ffmpeg
+// -version, which names the release or git revision, or "" if ffmpeg
+// can't be run.
+func ffmpegVersion() string {
+	out, versionErr := newCommand(context.Background(), "ffmpeg", "-version").Output()
+	if versionErr != nil {
+		log.Printf("Could not get the ffmpeg version for CacheVersion: %s", versionErr)
+		return ""
+	}
+	firstLine := strings.SplitN(string(out), "\n", 2)[0]
+	sum := sha256.Sum256([]byte(firstLine))
+	return hex.EncodeToString(sum[:4])
+}
+
+// ffmpegHasFilter reports whether ffmpeg was built with the filter name.
+func ffmpegHasFilter(name string) bool {
+	out, filtersErr := newCommand(context.Background(), "ffmpeg", "-hide_banner", "-filters").Output()
+	if filtersErr != nil {
+		log.Printf("Could not list the ffmpeg filters: %s", filtersErr)
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == name {
+			return true
+		}
+	}
+	return false
+}
 
-	http.ListenAndServe(fmt.Sprintf("%s:%d", config.Host, config.Port), nil)
+// ffmpegHasDemuxer reports whether ffmpeg was built with the demuxer name,
+// one of those listed together such as "mov,mp4,m4a".
+func ffmpegHasDemuxer(name string) bool {
+	out, demuxersErr := newCommand(context.Background(), "ffmpeg", "-hide_banner", "-demuxers").Output()
+	if demuxersErr != nil {
+		log.Printf("Could not list the ffmpeg demuxers: %s", demuxersErr)
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], "D") && stringInSlice(name, strings.Split(fields[1], ",")) {
+			return true
+		}
+	}
+	return false
+}
+
+// startFFmpeg starts cmd at the FFmpegNice priority. The priority can
+// only be lowered once the process is running, so ffmpeg briefly starts at
+// the server's own priority.
+func startFFmpeg(cmd *exec.Cmd) error {
+	startErr := cmd.Start()
+	if startErr != nil {
+		return checkEncoderErr(startErr)
+	}
+	if config.FFmpegNice != 0 {
+		niceErr := setNice(cmd.Process.Pid, config.FFmpegNice)
+		if niceErr != nil {
+			log.Printf("Could not set ffmpeg priority to %d: %s", config.FFmpegNice, niceErr)
+		}
+	}
+	return nil
+}
+
+// runFFmpeg is startFFmpeg followed by waiting for cmd to exit.
+func runFFmpeg(cmd *exec.Cmd) error {
+	startErr := startFFmpeg(cmd)
+	if startErr != nil {
+		return startErr
+	}
+	return cmd.Wait()
 }
 
 type TranscodeRet struct {
 	cmd *exec.Cmd
 	rc  *io.ReadCloser
+	// err is why ffmpeg couldn't be started, if it wasn't.
+	err error
+	// stderr is the end of ffmpeg's log for hardware transcodes and with
+	// DegradeToAudio, unless it went to the FFmpegLogDir file at logPath.
+	stderr  *tailWriter
+	logPath string
+	// degraded is set when the video was left out, see DegradeToAudio.
+	degraded bool
 }
 
-func transcodeFile(inputFile string, width int, outputFile string) TranscodeRet {
-	cmd := exec.Command(
-		"ffmpeg", "-y", "-i", inputFile,
-		"-filter_complex", fmt.Sprintf("scale=%d:-2[mid];[mid]split=2[out1][out2]", width),
-		"-map", "0:a", "-c:a", "copy",
-		"-map", "[out1]", "-f", "mp4", outputFile,
-		"-map", "0:a", "-c:a", "copy",
-		"-map", "[out2]", "-movflags", "isml+frag_keyframe", "-f", "ismv", "-",
-	)
+// succeeded waits for ffmpeg to exit, unless it already has, and reports
+// whether it exited cleanly.
+func (tr TranscodeRet) succeeded() bool {
+	if tr.cmd.ProcessState == nil {
+		tr.cmd.Wait()
+	}
+	return tr.cmd.ProcessState != nil && tr.cmd.ProcessState.Success()
+}
+
+// TranscodeOptions holds the per-request knobs that change the encoded
+// output.
+type TranscodeOptions struct {
+	Width int
+	// VideoTrack picks the input's video stream by its index among the
+	// video streams, for inputs with several programs. Zero is the first.
+	VideoTrack int
+	// Loudnorm normalises the audio to EBU R128 with ffmpeg's single-pass
+	// (dynamic) loudnorm filter.
+	Loudnorm bool
+	// TwoPass encodes the cached file in two passes at Bitrate instead of
+	// streaming a single-pass encode.
+	TwoPass bool
+	// Bitrate is the target video bitrate, MaxBitrate caps it for
+	// encodes without a target.
+	Bitrate    string
+	MaxBitrate string
+	// FPS caps the output frame rate. Zero keeps the source's.
+	FPS int
+	// CFR forces a constant output frame rate of that many frames per
+	// second. Zero leaves the timing as it is.
+	CFR int
+	// BurnSubtitles renders the SubtitleTrack, its index among the
+	// subtitle streams, into the video.
+	BurnSubtitles bool
+	SubtitleTrack int
+	// ToneMap converts HDR video to SDR.
+	ToneMap bool
+	// Interpolate converts to FPS with motion-compensated interpolation
+	// instead of dropping or duplicating frames, and may raise the frame
+	// rate above the source's.
+	Interpolate bool
+	// Codec is the video codec, "h264" or "h265".
+	Codec string
+	// Tune is the x264 -tune, one of x264Tunes.
+	Tune string
+	// Profile and Level constrain the output for older devices, one of
+	// x264Profiles and x264Levels.
+	Profile string
+	Level   string
+	// Metadata is written into the output container, on top of the
+	// source's metadata when CopyMetadata is set.
+	Metadata     map[string]string
+	CopyMetadata bool
+	// MultiAudio adds a stereo downmix track ahead of the original
+	// surround track.
+	MultiAudio bool
+	// Channels is the number of audio channels to mix down to. Zero
+	// keeps the source's.
+	Channels int
+	// Fragmented writes the file output as fragmented MP4, see
+	// FragmentedMP4.
+	Fragmented bool
+	// Visualization generates the video from the audio of audio-only
+	// sources, see AudioVisualization.
+	Visualization string
+	// LowLatency trades compression for getting the first frames out
+	// sooner: zerolatency tuning, a GOP of about a second and no
+	// B-frames.
+	LowLatency bool
+	// Quality is the ?quality= level, encoded at a constant quality
+	// instead of a bitrate, see codecQuality.
+	Quality string
+	// Hardware encodes on the GPU, see HardwareEncoder. It isn't part of
+	// the cache key, the outputs are interchangeable.
+	Hardware bool
+	// Sideways is set for sources rotated by 90 or 270 degrees whose
+	// frames are kept as they are, see KeepRotation.
+	Sideways bool
+	// ShortClip makes every frame a keyframe, for sources shorter than
+	// shortClipDuration, see ShortClips.
+	ShortClip bool
+	// X265Params are the libx265 parameters, see X265Params.
+	X265Params map[string]string
+	// LogName names the FFmpegLogDir log of the transcode. Like Hardware
+	// it isn't part of the cache key.
+	LogName string
+	// ColorPrimaries, ColorTransfer and ColorSpace are the color tags of
+	// the output, see ColorPrimaries. Only those set in the config are
+	// part of the cache key, the others come from the source.
+	ColorPrimaries string
+	ColorTransfer  string
+	ColorSpace     string
+	// AudioOnly leaves the video out, for sources it can't be decoded
+	// from, see DegradeToAudio.
+	AudioOnly bool
+}
+
+// audioArgs maps and encodes the audio of an output. source is the
+// filtergraph label carrying the filtered audio, or "" to copy the
+// input's audio. With MultiAudio the first audio stream becomes a stereo
+// AAC track, the default, followed by the untouched surround track.
+func (opts TranscodeOptions) audioArgs(source string) []string {
+	codec := "aac"
+	if source == "" {
+		// Optional, as silent sources have nothing to map.
+		source = "0:a?"
+		codec = "copy"
+	}
+	if opts.Channels > 0 {
+		// Changing the layout means encoding the audio again.
+		return []string{"-map", source, "-c:a", "aac", "-ac", strconv.Itoa(opts.Channels)}
+	}
+	if opts.MultiAudio == false {
+		return []string{"-map", source, "-c:a", codec}
+	}
+	if source == "0:a?" {
+		source = "0:a:0"
+	}
+	return []string{
+		"-map", source, "-map", "0:a:0",
+		"-c:a:0", "aac", "-ac:a:0", "2", "-c:a:1", "copy",
+		"-disposition:a:0", "default", "-disposition:a:1", "0",
+		"-metadata:s:a:0", "title=Stereo", "-metadata:s:a:1", "title=Surround",
+	}
+}
+
+// outputArgs are the ffmpeg options shared by every output of a
+// transcode.
+func (opts TranscodeOptions) outputArgs() []string {
+	args := opts.codecArgs()
+	if opts.Bitrate != "" {
+		args = append(args, "-b:v", opts.Bitrate)
+	}
+	if opts.MaxBitrate != "" {
+		bufsize := strconv.FormatInt(2*parseBitrate(opts.MaxBitrate), 10)
+		args = append(args, "-maxrate", opts.MaxBitrate, "-bufsize", bufsize)
+	}
+	if opts.Quality != "" && opts.Hardware {
+		// NVENC's constant quality is its -cq, its presets and tunes
+		// aren't x264's.
+		args = append(args, "-cq", strconv.Itoa(codecQuality(opts.Codec, opts.Quality).CRF))
+	} else if opts.Quality != "" {
+		quality := codecQuality(opts.Codec, opts.Quality)
+		args = append(args, "-crf", strconv.Itoa(quality.CRF))
+		if quality.Preset != "" {
+			args = append(args, "-preset", quality.Preset)
+		}
+	}
+	if opts.Tune != "" && opts.Hardware == false {
+		args = append(args, "-tune", opts.Tune)
+	}
+	if opts.Profile != "" {
+		// Every profile offered needs 8-bit 4:2:0, which some sources
+		// aren't.
+		args = append(args, "-profile:v", opts.Profile, "-pix_fmt", "yuv420p")
+	}
+	if opts.Level != "" {
+		args = append(args, "-level", opts.Level)
+	}
+	if opts.CFR > 0 {
+		args = append(args, "-vsync", "cfr", "-r", strconv.Itoa(opts.CFR))
+	}
+	if len(opts.X265Params) > 0 && opts.Hardware == false && opts.TwoPass == false {
+		// Two-pass encodes pass them along with their passArgs.
+		args = append(args, "-x265-params", opts.x265Params())
+	}
+	if opts.ColorPrimaries != "" {
+		args = append(args, "-color_primaries", opts.ColorPrimaries)
+	}
+	if opts.ColorTransfer != "" {
+		args = append(args, "-color_trc", opts.ColorTransfer)
+	}
+	if opts.ColorSpace != "" {
+		args = append(args, "-colorspace", opts.ColorSpace)
+	}
+	if opts.LowLatency {
+		gop := opts.FPS
+		if gop == 0 {
+			gop = 30
+		}
+		args = append(args, "-g", strconv.Itoa(gop), "-bf", "0")
+	}
+	if opts.Fragmented {
+		// Fixed keyframes keep the fragments of the file and the stream
+		// aligned.
+		args = append(args, "-force_key_frames", "expr:gte(t,n_forced*2)")
+	}
+	if opts.ShortClip {
+		// A clip shorter than the keyframe interval is a single GOP,
+		// which some players won't start. Making every frame a keyframe
+		// costs little on a clip that short.
+		args = append(args, "-g", "1", "-bf", "0")
+	}
+	if opts.CopyMetadata {
+		args = append(args, "-map_metadata", "0")
+	} else {
+		args = append(args, "-map_metadata", "-1")
+	}
+	keys := make([]string, 0, len(opts.Metadata))
+	for key := range opts.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "-metadata", fmt.Sprintf("%s=%s", key, opts.Metadata[key]))
+	}
+	return append(args, config.FFmpegOutputArgs...)
+}
+
+// codecArgs select the video encoder. HEVC in MP4 is tagged hvc1, which
+// Apple's players insist on.
+func (opts TranscodeOptions) codecArgs() []string {
+	if opts.Codec == "h265" && opts.Hardware {
+		return []string{"-c:v", "hevc_nvenc", "-tag:v", "hvc1"}
+	}
+	if opts.Codec == "h265" {
+		return []string{"-c:v", "libx265", "-tag:v", "hvc1"}
+	}
+	if opts.Hardware {
+		return []string{"-c:v", "h264_nvenc"}
+	}
+	return []string{"-c:v", "libx264"}
+}
+
+// fixedColorTag returns the color tag configured as tag, or "" when it
+// is left out or copied from the source.
+func fixedColorTag(tag string) string {
+	if tag == "source" {
+		return ""
+	}
+	return tag
+}
+
+// copyColorTags sets the color tags configured as "source" to those of
+// its video stream, or to BT.709 when it is tone mapped, which is what the
+// tone mapping turns it into.
+func (opts *TranscodeOptions) copyColorTags(stream probeStream) {
+	copyTag := func(configured string, tag *string, source string) {
+		if configured != "source" {
+			return
+		}
+		if opts.ToneMap {
+			*tag = "bt709"
+		} else if source != "unknown" && source != "reserved" && colorTagRegex.MatchString(source) {
+			*tag = source
+		}
+	}
+	copyTag(config.ColorPrimaries, &opts.ColorPrimaries, stream.ColorPrimaries)
+	copyTag(config.ColorTransfer, &opts.ColorTransfer, stream.ColorTransfer)
+	copyTag(config.ColorSpace, &opts.ColorSpace, stream.ColorSpace)
+}
+
+// x265Params joins the X265Params into an -x265-params value, sorted by
+// key.
+func (opts TranscodeOptions) x265Params() string {
+	params := make([]string, 0, len(opts.X265Params))
+	for key, value := range opts.X265Params {
+		params = append(params, key+"="+value)
+	}
+	sort.Strings(params)
+	return strings.Join(params, ":")
+}
+
+// passArgs are the ffmpeg options of pass n of a two-pass encode logging
+// to passLog. libx265 only takes them through its own parameters, which
+// ffmpeg only takes once, so the X265Params go along.
+func (opts TranscodeOptions) passArgs(n int, passLog string) []string {
+	if opts.Codec == "h265" {
+		x265Params := fmt.Sprintf("pass=%d:stats=%s.log", n, passLog)
+		if len(opts.X265Params) > 0 {
+			x265Params += ":" + opts.x265Params()
+		}
+		return []string{"-x265-params", x265Params}
+	}
+	return []string{"-pass", strconv.Itoa(n), "-passlogfile", passLog}
+}
+
+// streamArgs are the ffmpeg options of the streamed output. ismv can't
+// carry HEVC, which is streamed as plain fragmented MP4 instead.
+func (opts TranscodeOptions) streamArgs() []string {
+	if opts.Codec == "h265" {
+		return []string{"-movflags", "frag_keyframe+empty_moov+default_base_moof", "-f", "mp4", "-"}
+	}
+	return []string{"-movflags", "isml+frag_keyframe", "-f", "ismv", "-"}
+}
+
+// fileArgs are the ffmpeg options of the cached MP4 file output. A
+// fragmented file starts with an empty moov box, its init segment, and
+// is followed by a fragment per keyframe, so it doesn't need moving the
+// moov to the front to start playing.
+func (opts TranscodeOptions) fileArgs() []string {
+	if opts.Fragmented {
+		return []string{"-movflags", "+frag_keyframe+empty_moov+default_base_moof", "-f", "mp4"}
+	}
+	return []string{"-f", "mp4"}
+}
+
+// videoInput is the filtergraph label of the input video stream, or ""
+// to leave it to ffmpeg to pick the first one. With a Visualization it is
+// the label of the video drawn from the audio, preceded by its filter.
+func (opts TranscodeOptions) videoInput() string {
+	height := opts.Width * 9 / 16
+	height += height % 2
+	switch opts.Visualization {
+	case "waves":
+		return fmt.Sprintf("[0:a]showwaves=s=%dx%d:mode=cline:rate=25,format=yuv420p[vis];[vis]", opts.Width, height)
+	case "spectrum":
+		return fmt.Sprintf("[0:a]showspectrum=s=%dx%d:mode=combined:slide=scroll,fps=25,format=yuv420p[vis];[vis]", opts.Width, height)
+	}
+	if opts.VideoTrack > 0 {
+		return fmt.Sprintf("[0:v:%d]", opts.VideoTrack)
+	}
+	return ""
+}
+
+// videoFilter is the filter chain applied to the video stream of
+// inputFile.
+func (opts TranscodeOptions) videoFilter(inputFile string) string {
+	filter := fmt.Sprintf("scale=%d:-2", opts.Width)
+	if opts.Sideways {
+		// The frames are displayed rotated, so their height becomes the
+		// width seen by the viewer.
+		filter = fmt.Sprintf("scale=-2:%d", opts.Width)
+	}
+	if opts.ToneMap {
+		// Linearize, map the BT.2020 primaries to BT.709 and compress the
+		// highlights with hable, after scaling as zscale in floats is slow.
+		filter += ",zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+	}
+	if opts.BurnSubtitles {
+		// Rendered after scaling, so the text is drawn at the output
+		// resolution rather than scaled down with the picture.
+		filter += fmt.Sprintf(",subtitles=filename=%s:si=%d", escapeFilterPath(inputFile), opts.SubtitleTrack)
+	}
+	if opts.FPS > 0 && opts.Interpolate {
+		// Interpolating after scaling keeps the motion estimation on
+		// the smaller frames.
+		filter += fmt.Sprintf(",minterpolate=fps=%d:mi_mode=mci", opts.FPS)
+	} else if opts.FPS > 0 {
+		filter += fmt.Sprintf(",fps=%d", opts.FPS)
+	}
+	return filter
+}
+
+// escapeFilterPath escapes name for use as a filter option value in a
+// filtergraph: once for the option parser and again for the graph parser.
+func escapeFilterPath(name string) string {
+	optionEscaper := strings.NewReplacer("\\", "\\\\", "'", "\\'", ":", "\\:")
+	graphEscaper := strings.NewReplacer("\\", "\\\\", "'", "\\'", "[", "\\[", "]", "\\]", ",", "\\,", ";", "\\;")
+	return graphEscaper.Replace(optionEscaper.Replace(name))
+}
+
+// cacheKey hashes every option that changes the output bytes apart from
+// the width, which has its own directory, along with the CacheVersion.
+// Identical options always give the same key and the plain scaled
+// rendition of an unversioned cache gives "".
+func cacheKey(opts TranscodeOptions) string {
+	params := cacheParams(opts)
+	if config.CacheVersion != "" {
+		params.Set("version", config.CacheVersion)
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	// Encode sorts by name, so the key doesn't depend on the order the
+	// options were set in.
+	sum := sha256.Sum256([]byte(params.Encode()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// cacheParams lists the options going into the cacheKey. Any new option
+// must be added here or its outputs will overwrite each other.
+func cacheParams(opts TranscodeOptions) url.Values {
+	params := url.Values{}
+	if opts.Loudnorm {
+		params.Set("loudnorm", "1")
+	}
+	if opts.TwoPass {
+		params.Set("twopass", "1")
+	}
+	if opts.Bitrate != "" {
+		params.Set("bitrate", opts.Bitrate)
+	}
+	if opts.MaxBitrate != "" {
+		params.Set("maxrate", opts.MaxBitrate)
+	}
+	if opts.FPS > 0 {
+		params.Set("fps", strconv.Itoa(opts.FPS))
+	}
+	if opts.Interpolate {
+		params.Set("interpolate", "1")
+	}
+	if opts.VideoTrack > 0 {
+		params.Set("vtrack", strconv.Itoa(opts.VideoTrack))
+	}
+	if opts.Fragmented {
+		params.Set("fragmented", "1")
+	}
+	if opts.LowLatency {
+		params.Set("lowlatency", "1")
+	}
+	if opts.Tune != "" {
+		params.Set("tune", opts.Tune)
+	}
+	if opts.Profile != "" {
+		params.Set("profile", opts.Profile)
+	}
+	if opts.Level != "" {
+		params.Set("level", opts.Level)
+	}
+	for key, value := range opts.Metadata {
+		params.Set("meta_"+key, value)
+	}
+	if len(opts.X265Params) > 0 {
+		params.Set("x265params", opts.x265Params())
+	}
+	if opts.ColorPrimaries != "" {
+		params.Set("color_primaries", opts.ColorPrimaries)
+	}
+	if opts.ColorTransfer != "" {
+		params.Set("color_trc", opts.ColorTransfer)
+	}
+	if opts.ColorSpace != "" {
+		params.Set("colorspace", opts.ColorSpace)
+	}
+	if opts.AudioOnly {
+		params.Set("degraded", "audio")
+	}
+	if opts.CopyMetadata {
+		params.Set("copymetadata", "1")
+	}
+	if opts.MultiAudio {
+		params.Set("audio", "multi")
+	}
+	if opts.Channels > 0 {
+		params.Set("channels", strconv.Itoa(opts.Channels))
+	}
+	if opts.Quality != "" {
+		params.Set("quality", opts.Quality)
+	}
+	if opts.CFR > 0 {
+		params.Set("cfr", strconv.Itoa(opts.CFR))
+	}
+	if opts.BurnSubtitles {
+		params.Set("burnsub", strconv.Itoa(opts.SubtitleTrack))
+	}
+	if opts.ToneMap {
+		params.Set("tonemap", "1")
+	}
+	if opts.Codec != "h264" {
+		params.Set("codec", opts.Codec)
+	}
+	return params
+}
+
+// loudnormFilter targets the EBU R128 streaming loudness. Single-pass
+// loudnorm adjusts the gain on the fly, so it is less accurate than a
+// measured two-pass run but doesn't need to read the input twice. It also
+// resamples to 192kHz, hence the aresample back to 48kHz.
+const loudnormFilter = "loudnorm=I=-16:TP=-1.5:LRA=11,aresample=48000"
+
+// transcodeFile starts ffmpeg scaling inputFile, writing the MP4 to
+// outputFile and a fragmented copy to stdout for streaming. An empty
+// outputFile only produces the stream.
+func transcodeFile(ctx context.Context, inputFile string, opts TranscodeOptions, outputFile string) TranscodeRet {
+	var filters []string
+	if opts.AudioOnly == false && outputFile == "" {
+		filters = append(filters, opts.videoInput()+opts.videoFilter(inputFile)+"[out2]")
+	} else if opts.AudioOnly == false {
+		filters = append(filters, opts.videoInput()+opts.videoFilter(inputFile)+"[mid];[mid]split=2[out1][out2]")
+	}
+	audio1 := opts.audioArgs("")
+	audio2 := opts.audioArgs("")
+	if opts.Loudnorm {
+		if outputFile == "" {
+			filters = append(filters, fmt.Sprintf("[0:a]%s[aout2]", loudnormFilter))
+		} else {
+			filters = append(filters, fmt.Sprintf("[0:a]%s,asplit=2[aout1][aout2]", loudnormFilter))
+		}
+		audio1 = opts.audioArgs("[aout1]")
+		audio2 = opts.audioArgs("[aout2]")
+	}
+	args := []string{"-y"}
+	if opts.AudioOnly {
+		// Ahead of the input, so that its video isn't even decoded.
+		args = append(args, "-vn")
+	} else if config.DegradeToAudio {
+		// Once the stream is under way it's too late to leave the video
+		// out, carry on past the frames that fail to decode instead of
+		// giving up on the rest.
+		args = append(args, "-max_error_rate", "1", "-err_detect", "ignore_err")
+	}
+	args = append(args, decodeArgs(inputFile)...)
+	if len(filters) > 0 {
+		args = append(args, "-filter_complex", strings.Join(filters, ";"))
+	}
+	if outputFile != "" {
+		args = append(args, audio1...)
+		if opts.AudioOnly == false {
+			args = append(args, "-map", "[out1]")
+		}
+		args = append(args, opts.outputArgs()...)
+		args = append(args, opts.fileArgs()...)
+		args = append(args, outputFile)
+	}
+	args = append(args, audio2...)
+	if opts.AudioOnly == false {
+		args = append(args, "-map", "[out2]")
+	}
+	args = append(args, opts.outputArgs()...)
+	args = append(args, opts.streamArgs()...)
+	var progressReader, progressWriter *os.File
+	if config.SlowTranscodeRatio > 0 {
+		var pipeErr error
+		progressReader, progressWriter, pipeErr = os.Pipe()
+		if pipeErr == nil {
+			// The first of the ExtraFiles is ffmpeg's fd 3.
+			args = append([]string{"-progress", "pipe:3"}, args...)
+		} else {
+			log.Printf("Could not create progress pipe: %s", pipeErr)
+		}
+	}
+	cmd := newCommand(ctx, "ffmpeg", args...)
+	if progressWriter != nil {
+		cmd.ExtraFiles = []*os.File{progressWriter}
+	}
+	var stderr *tailWriter
+	logFile := openFFmpegLog(opts.LogName, args)
+	if logFile != nil {
+		cmd.Stderr = logFile
+	} else if opts.Hardware || config.DegradeToAudio {
+		// Kept to tell whether the GPU refused the session, or the video
+		// couldn't be decoded.
+		stderr = &tailWriter{}
+		cmd.Stderr = stderr
+	}
 	reader, readerErr := cmd.StdoutPipe()
 	if readerErr != nil {
-		fmt.Printf("Error %s\n", readerErr.Error())
+		log.Printf("Could not read the output of ffmpeg for %s: %s", inputFile, readerErr)
 	}
-	err := cmd.Start()
+	err := startFFmpeg(cmd)
 	if err != nil {
-		fmt.Printf("Error %s\n", err.Error())
+		log.Printf("Could not start ffmpeg for %s: %s", inputFile, err)
+	}
+	logPath := ""
+	if logFile != nil {
+		// ffmpeg writes to its own copy of the file.
+		logPath = logFile.Name()
+		logFile.Close()
+	}
+	if progressWriter != nil {
+		// Only ffmpeg writes to the pipe, so that the reader sees EOF
+		// when it exits.
+		progressWriter.Close()
+		if err == nil {
+			go watchProgress(progressReader, inputFile)
+		} else {
+			progressReader.Close()
+		}
 	}
 	var tr TranscodeRet
 	tr.cmd = cmd
 	tr.rc = &reader
+	tr.err = err
+	tr.stderr = stderr
+	tr.logPath = logPath
 	return tr
 }
+
+// ffmpegLogName returns the name of the FFmpegLogDir log of the request
+// with requestID, which clients may have picked: IDs that aren't a plain
+// name are hashed.
+func ffmpegLogName(requestID string) string {
+	if namespaceRegex.MatchString(requestID) && len(requestID) <= 64 {
+		return requestID
+	}
+	sum := sha256.Sum256([]byte(requestID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// openFFmpegLog opens the FFmpegLogDir log named name for appending, with
+// a line giving the ffmpeg command line of args, for ffmpeg's stderr. It
+// returns nil when there's no FFmpegLogDir or the log can't be opened.
+func openFFmpegLog(name string, args []string) *os.File {
+	if config.FFmpegLogDir == "" || name == "" {
+		return nil
+	}
+	logFile, openErr := os.OpenFile(path.Join(config.FFmpegLogDir, name+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if openErr != nil {
+		log.Printf("Could not open ffmpeg log: %s", openErr)
+		return nil
+	}
+	fmt.Fprintf(logFile, "%s ffmpeg %s\n", time.Now().Format(time.RFC3339), strings.Join(args, " "))
+	return logFile
+}
+
+// logFFmpeg sends the stderr of cmd, ffmpeg run with args, to the
+// FFmpegLogDir log named name, or the server's own stderr when it has
+// none. The returned func closes the log, once cmd has exited.
+func logFFmpeg(cmd *exec.Cmd, name string, args []string) func() {
+	cmd.Stderr = os.Stderr
+	logFile := openFFmpegLog(name, args)
+	if logFile == nil {
+		return func() {}
+	}
+	cmd.Stderr = logFile
+	return func() {
+		logFile.Close()
+	}
+}
+
+// expireFFmpegLogs removes the logs in FFmpegLogDir last written to more
+// than retention ago, checking every hour.
+func expireFFmpegLogs(retention time.Duration) {
+	for {
+		infos, readErr := ioutil.ReadDir(config.FFmpegLogDir)
+		if readErr != nil {
+			log.Printf("Could not list %s: %s", config.FFmpegLogDir, readErr)
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), ".log") && time.Since(info.ModTime()) > retention {
+				os.Remove(path.Join(config.FFmpegLogDir, info.Name()))
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// stderrTail returns the end of ffmpeg's log, from its FFmpegLogDir file
+// when it has one, or "" when it wasn't kept.
+func (tr TranscodeRet) stderrTail() string {
+	if tr.logPath != "" {
+		data, _ := ioutil.ReadFile(tr.logPath)
+		if len(data) > tailWriterSize {
+			data = data[len(data)-tailWriterSize:]
+		}
+		return string(data)
+	}
+	if tr.stderr == nil {
+		return ""
+	}
+	return tr.stderr.String()
+}
+
+// defaultFallbackWait is how long transcodeWithFallbacks waits for
+// ffmpeg to fail before leaving it be, unless FallbackWait is set. The
+// GPU refuses sessions as the encoder opens, and undecodable video fails
+// as it is opened too, well within it, while proxies waiting for the
+// headers aren't kept waiting for long.
+const defaultFallbackWait = time.Second
+
+// nvencSessionError is what ffmpeg logs when NVENC has no session left
+// (or no memory for one).
+const nvencSessionError = "OpenEncodeSessionEx failed"
+
+// transcodeWithFallbacks is transcodeFile, started again differently
+// when it fails before anything was sent to the client: in software when
+// the GPU refuses a session (HardwareFallback), or without the video when
+// it can't be decoded (DegradeToAudio).
+func transcodeWithFallbacks(ctx context.Context, inputFile string, opts TranscodeOptions, outputFile string) TranscodeRet {
+	tret := transcodeFile(ctx, inputFile, opts, outputFile)
+	hardware := opts.Hardware && config.HardwareFallback
+	degrade := config.DegradeToAudio && opts.AudioOnly == false
+	if (hardware == false && degrade == false) || tret.cmd.Process == nil {
+		return tret
+	}
+	// The first read runs on its own so that a slow start isn't held
+	// up for longer than the FallbackWait, firstReadReader picks up its
+	// result either way.
+	rc := *(tret.rc)
+	first := make(chan firstRead, 1)
+	go func() {
+		buf := make([]byte, 32*1024)
+		n, readErr := rc.Read(buf)
+		first <- firstRead{data: buf[:n], err: readErr}
+	}()
+	wait := config.FallbackWait.Duration
+	if wait <= 0 {
+		wait = defaultFallbackWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case result := <-first:
+		if len(result.data) == 0 && result.err != nil {
+			// Waiting is needed for the stderr to be complete, and
+			// ffmpeg has exited anyway.
+			tret.cmd.Wait()
+			stderr := tret.stderrTail()
+			if hardware && strings.Contains(stderr, nvencSessionError) {
+				log.Printf("Hardware encoder has no session left, transcoding %s in software", inputFile)
+				atomic.AddInt64(&hardwareFallbacks, 1)
+				opts.Hardware = false
+				return transcodeWithFallbacks(ctx, inputFile, opts, outputFile)
+			}
+			if degrade && videoUndecodable(ctx, inputFile, stderr) {
+				log.Printf("Could not decode the video of %s, transcoding its audio only", inputFile)
+				opts.AudioOnly = true
+				tret = transcodeWithFallbacks(ctx, inputFile, opts, outputFile)
+				tret.degraded = true
+				return tret
+			}
+		}
+		first <- result
+	case <-timer.C:
+	}
+	var reader io.ReadCloser = &firstReadReader{ReadCloser: rc, first: first}
+	tret.rc = &reader
+	return tret
+}
+
+// decodeErrorRegex matches ffmpeg failing to open or decode an input
+// stream, capturing its index. Since ffmpeg 6 the messages of the video
+// decoders are prefixed with [vist#0:{index}/{codec} @ ...].
+var decodeErrorRegex = regexp.MustCompile("(?:Error while decoding stream #0:|Error while opening decoder for input stream #0:|not found for input stream #0:|\\[vist#0:)([0-9]+)")
+
+// videoUndecodable reports whether stderr, the log of a failed transcode
+// of inputFile, blames one of its video streams, and it has audio to fall
+// back on.
+func videoUndecodable(ctx context.Context, inputFile string, stderr string) bool {
+	matches := decodeErrorRegex.FindAllStringSubmatch(stderr, -1)
+	if len(matches) == 0 {
+		return false
+	}
+	probe, probeErr := probeFile(ctx, inputFile)
+	if probeErr != nil || probe.audioChannels() == 0 {
+		return false
+	}
+	for _, match := range matches {
+		index, _ := strconv.Atoi(match[1])
+		for _, stream := range probe.Streams {
+			if stream.Index == index && stream.CodecType == "video" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// firstRead is the outcome of a single Read.
+type firstRead struct {
+	data []byte
+	err  error
+}
+
+// firstReadReader replays the read done by transcodeWithFallbacks before
+// reading on from the ffmpeg output.
+type firstReadReader struct {
+	io.ReadCloser
+	first   chan firstRead
+	pending *firstRead
+}
+
+func (r *firstReadReader) Read(p []byte) (int, error) {
+	if r.first != nil {
+		result := <-r.first
+		r.first = nil
+		r.pending = &result
+	}
+	if r.pending != nil {
+		n := copy(p, r.pending.data)
+		r.pending.data = r.pending.data[n:]
+		if len(r.pending.data) > 0 {
+			return n, nil
+		}
+		readErr := r.pending.err
+		r.pending = nil
+		return n, readErr
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// tailWriter keeps the last tailWriterSize bytes written to it, such as
+// the end of ffmpeg's log.
+type tailWriter struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+const tailWriterSize = 8 * 1024
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.data = append(w.data, p...)
+	if len(w.data) > tailWriterSize {
+		w.data = append([]byte(nil), w.data[len(w.data)-tailWriterSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return string(w.data)
+}
@@ -0,0 +1,1625 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeOutput is what the fake ffmpeg writes, to stdout and to the output
+// file, several reads' worth.
+var fakeOutput = []byte(strings.Repeat("fake mp4 output\n", 4096))
+
+// testProbe is the canned ffprobe output of a plain 1080p source.
+const testProbe = `{"streams":[{"index":0,"codec_type":"video","codec_name":"h264","width":1920,"height":1080,"avg_frame_rate":"30/1"},{"index":1,"codec_type":"audio","codec_name":"aac","channels":2}],"format":{"duration":"12.5"}}`
+
+// TestHelperProcess isn't a test, it stands in for ffmpeg and ffprobe
+// when run by the newCommand of newTestServer. FAKE_MODE picks how the
+// fake ffmpeg behaves:
+//
+//	""      writes fakeOutput to stdout and the output file, and exits
+//	"fail"  writes half of fakeOutput to stdout and exits with 1
+//	"slow"  writes its pid to FAKE_PID and trickles output for 10s
+//	"short" trickles output for half a second, then goes on as ""
+//	"novideo" fails to decode the video, unless it is left out with -vn
+//
+// The fake ffprobe prints FAKE_PROBE, or fails when it's empty.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	name, args := args[1], args[2:]
+	calls, _ := os.OpenFile(os.Getenv("FAKE_CALLS"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	fmt.Fprintf(calls, "%s %s\n", name, strings.Join(args, " "))
+	calls.Close()
+	if name == "ffprobe" {
+		if os.Getenv("FAKE_PROBE") == "" {
+			os.Exit(1)
+		}
+		os.Stdout.WriteString(os.Getenv("FAKE_PROBE"))
+		os.Exit(0)
+	}
+	switch os.Getenv("FAKE_MODE") {
+	case "novideo":
+		if stringInSlice("-vn", args) == false {
+			os.Stderr.WriteString("[vist#0:0/h264 @ 0x1] Error while opening decoder for input stream #0:0\n")
+			os.Exit(1)
+		}
+	case "fail":
+		os.Stdout.Write(fakeOutput[:len(fakeOutput)/2])
+		os.Stderr.WriteString("Conversion failed!\n")
+		os.Exit(1)
+	case "slow":
+		ioutil.WriteFile(os.Getenv("FAKE_PID"), []byte(strconv.Itoa(os.Getpid())), 0644)
+		for ii := 0; ii < 500; ii++ {
+			os.Stdout.Write(fakeOutput[:1024])
+			time.Sleep(20 * time.Millisecond)
+		}
+	case "short":
+		for ii := 0; ii < 25; ii++ {
+			os.Stdout.Write(fakeOutput[:1024])
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	for ii, arg := range args {
+		if ii > 0 && args[ii-1] != "-i" && strings.HasPrefix(arg, os.Getenv("FAKE_OUTPUT_DIR")+"/") {
+			ioutil.WriteFile(arg, fakeOutput, 0644)
+		}
+	}
+	if len(args) > 0 && args[len(args)-1] == "-" {
+		os.Stdout.Write(fakeOutput)
+	}
+	os.Exit(0)
+}
+
+// testServer is the server's handler on a fresh config, whose ffmpeg and
+// ffprobe are TestHelperProcess.
+type testServer struct {
+	*httptest.Server
+	inputDir  string
+	outputDir string
+	calls     string
+	pid       string
+	// mode and probe are the FAKE_MODE and FAKE_PROBE of the commands
+	// started from then on.
+	mode  string
+	probe string
+}
+
+// newTestServer resets the server's globals to a config caching into a
+// temporary directory, and starts it. Tests change the config before
+// their first request.
+func newTestServer(t testing.TB) *testServer {
+	dir := t.TempDir()
+	ts := &testServer{
+		inputDir:  path.Join(dir, "in"),
+		outputDir: path.Join(dir, "out"),
+		calls:     path.Join(dir, "calls"),
+		pid:       path.Join(dir, "pid"),
+		probe:     testProbe,
+	}
+	os.Mkdir(ts.inputDir, os.ModePerm)
+	os.Mkdir(ts.outputDir, os.ModePerm)
+	config = JSONConfig{
+		InputDir:  ts.inputDir,
+		OutputDir: ts.outputDir,
+		Widths:    []int{240, 480},
+	}
+	queue = newTranscodeQueue(2, 0, 0, false)
+	jobs = newJobRegistry()
+	growing = newGrowingRegistry()
+	stats = newServerStats(config.Widths)
+	memCache = newMemoryCache(0)
+	sources = &sourceRules{}
+	configFile = ""
+	newCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, os.Args[0], append([]string{"-test.run=TestHelperProcess", "--", name}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GO_WANT_HELPER_PROCESS=1",
+			"FAKE_MODE="+ts.mode,
+			"FAKE_PROBE="+ts.probe,
+			"FAKE_CALLS="+ts.calls,
+			"FAKE_PID="+ts.pid,
+			"FAKE_OUTPUT_DIR="+ts.outputDir)
+		return cmd
+	}
+	ts.Server = httptest.NewServer(newHandler())
+	t.Cleanup(func() {
+		ts.Close()
+		newCommand = exec.CommandContext
+	})
+	return ts
+}
+
+// writeSource creates the source name in the InputDir.
+func (ts *testServer) writeSource(t testing.TB, name string, data string) {
+	writeErr := ioutil.WriteFile(path.Join(ts.inputDir, name), []byte(data), 0644)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+}
+
+// cacheFile is where the output of reqPath is cached.
+func (ts *testServer) cacheFile(t testing.TB, reqPath string) string {
+	treq, _, msg := parseTranscodeRequest(httptest.NewRequest(http.MethodGet, reqPath, nil), reqPath)
+	if treq == nil {
+		t.Fatalf("Invalid request %s: %s", reqPath, msg)
+	}
+	return treq.cacheFile()
+}
+
+// writeCached caches data as the output of reqPath.
+func (ts *testServer) writeCached(t testing.TB, reqPath string, data string) {
+	cacheFile := ts.cacheFile(t, reqPath)
+	os.MkdirAll(path.Dir(cacheFile), os.ModePerm)
+	writeErr := ioutil.WriteFile(cacheFile, []byte(data), 0644)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+}
+
+// commands returns the command lines name, ffmpeg or ffprobe, was run
+// with so far.
+func (ts *testServer) commands(name string) []string {
+	data, _ := ioutil.ReadFile(ts.calls)
+	var calls []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			calls = append(calls, line)
+		}
+	}
+	return calls
+}
+
+// waitCommands waits for name to have been run n times.
+func (ts *testServer) waitCommands(t *testing.T, name string, n int) {
+	for start := time.Now(); len(ts.commands(name)) < n; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%s ran %d times, want %d", name, len(ts.commands(name)), n)
+		}
+	}
+}
+
+// get requests reqPath, returning the response with its body read.
+func (ts *testServer) get(t testing.TB, reqPath string) (*http.Response, string) {
+	return ts.do(t, http.MethodGet, reqPath, nil)
+}
+
+// do sends a method request for reqPath with header, returning the
+// response with its body read.
+func (ts *testServer) do(t testing.TB, method string, reqPath string, header http.Header) (*http.Response, string) {
+	req, reqErr := http.NewRequest(method, ts.URL+reqPath, nil)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, doErr := http.DefaultClient.Do(req)
+	if doErr != nil {
+		t.Fatal(doErr)
+	}
+	defer resp.Body.Close()
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return resp, string(body)
+}
+
+// getHTTP10 is do for a GET, as an HTTP/1.0 client, which net/http
+// can't be.
+func (ts *testServer) getHTTP10(t *testing.T, reqPath string, header http.Header) (*http.Response, string) {
+	conn, dialErr := net.Dial("tcp", ts.Listener.Addr().String())
+	if dialErr != nil {
+		t.Fatal(dialErr)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s HTTP/1.0\r\n", reqPath)
+	header.Write(conn)
+	fmt.Fprintf(conn, "\r\n")
+	resp, respErr := http.ReadResponse(bufio.NewReader(conn), nil)
+	if respErr != nil {
+		t.Fatal(respErr)
+	}
+	defer resp.Body.Close()
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return resp, string(body)
+}
+
+// waitIdle waits for the running transcodes to be done with.
+func waitIdle(t *testing.T) {
+	for start := time.Now(); len(jobs.list()) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Transcodes still running")
+		}
+	}
+}
+
+// assertNoTempFiles fails when anything besides the cached outputs is
+// left in dir.
+func assertNoTempFiles(t *testing.T, dir string, cached ...string) {
+	infos, _ := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		if stringInSlice(path.Join(dir, info.Name()), cached) == false {
+			t.Errorf("Temporary file %s left behind", info.Name())
+		}
+	}
+}
+
+// assertExited fails when the fake ffmpeg whose pid is in pidFile is
+// still running.
+func assertExited(t *testing.T, pidFile string) {
+	pidData, _ := ioutil.ReadFile(pidFile)
+	pid, _ := strconv.Atoi(string(pidData))
+	process, findErr := os.FindProcess(pid)
+	if pid == 0 || (findErr == nil && process.Signal(syscall.Signal(0)) == nil) {
+		t.Errorf("ffmpeg (pid %d) still running", pid)
+	}
+}
+
+func TestCacheMiss(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeSource(t, "a.mp4", "source")
+	resp, body := ts.get(t, "/240p/a.mp4")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got status %d, want 200", resp.StatusCode)
+	}
+	if body != string(fakeOutput) {
+		t.Errorf("Got %d bytes, want the %d of ffmpeg's output", len(body), len(fakeOutput))
+	}
+	if len(ts.commands("ffmpeg")) != 1 {
+		t.Errorf("Ran ffmpeg %d times, want once", len(ts.commands("ffmpeg")))
+	}
+	cacheFile := ts.cacheFile(t, "/240p/a.mp4")
+	cached, readErr := ioutil.ReadFile(cacheFile)
+	if readErr != nil || string(cached) != string(fakeOutput) {
+		t.Errorf("Output not cached at %s: %v", cacheFile, readErr)
+	}
+	assertNoTempFiles(t, path.Dir(cacheFile), cacheFile)
+}
+
+func TestCacheHit(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeSource(t, "a.mp4", "source")
+	cacheFile := ts.cacheFile(t, "/240p/a.mp4")
+	os.MkdirAll(path.Dir(cacheFile), os.ModePerm)
+	ioutil.WriteFile(cacheFile, []byte("cached output"), 0644)
+	resp, body := ts.get(t, "/240p/a.mp4")
+	if resp.StatusCode != http.StatusOK || body != "cached output" {
+		t.Fatalf("Got %d %q, want 200 %q", resp.StatusCode, body, "cached output")
+	}
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len("cached output")) {
+		t.Errorf("Got Content-Length %q", resp.Header.Get("Content-Length"))
+	}
+	if len(ts.commands("ffmpeg")) > 0 {
+		t.Errorf("Ran ffmpeg for a cached file: %v", ts.commands("ffmpeg"))
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	ts := newTestServer(t)
+	ts.mode = "slow"
+	ts.writeSource(t, "a.mp4", "source")
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/240p/a.mp4", nil)
+	resp, respErr := http.DefaultClient.Do(req)
+	if respErr != nil {
+		t.Fatal(respErr)
+	}
+	buf := make([]byte, 1024)
+	_, readErr := resp.Body.Read(buf)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	cancel()
+	resp.Body.Close()
+	waitIdle(t)
+	assertExited(t, ts.pid)
+	cacheFile := ts.cacheFile(t, "/240p/a.mp4")
+	if _, statErr := os.Stat(cacheFile); statErr == nil {
+		t.Error("Cancelled output was cached")
+	}
+	assertNoTempFiles(t, path.Dir(cacheFile))
+}
+
+func TestTranscodeFailure(t *testing.T) {
+	ts := newTestServer(t)
+	ts.mode = "fail"
+	ts.writeSource(t, "a.mp4", "source")
+	cacheFile := ts.cacheFile(t, "/240p/a.mp4")
+
+	// Streamed, the headers are gone by the time ffmpeg fails, the
+	// client only sees the stream stop.
+	resp, body := ts.get(t, "/240p/a.mp4")
+	if resp.StatusCode != http.StatusOK || len(body) != len(fakeOutput)/2 {
+		t.Errorf("Got %d with %d bytes, want 200 with %d", resp.StatusCode, len(body), len(fakeOutput)/2)
+	}
+	if _, statErr := os.Stat(cacheFile); statErr == nil {
+		t.Error("Failed output was cached")
+	}
+	assertNoTempFiles(t, path.Dir(cacheFile))
+
+	// Buffered for HTTP/1.0, the failure gets a status of its own.
+	resp, _ = ts.getHTTP10(t, "/240p/a.mp4", nil)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Got status %d, want 500", resp.StatusCode)
+	}
+	if _, statErr := os.Stat(cacheFile); statErr == nil {
+		t.Error("Failed output was cached")
+	}
+	assertNoTempFiles(t, path.Dir(cacheFile))
+}
+
+func TestDemandQueueRunsKeyOnce(t *testing.T) {
+	q := newTranscodeQueue(2, 0, 0, true)
+	ctx := context.Background()
+	q.acquire(ctx, "A", "a")
+	q.acquire(ctx, "K", "k")
+	type result struct {
+		key string
+		err error
+	}
+	results := make(chan result, 4)
+	for ii, key := range []string{"K", "K", "K", "L"} {
+		go func(key string) {
+			results <- result{key, q.acquire(ctx, key, strings.ToLower(key))}
+		}(key)
+		for q.length() < ii+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	q.release("A", "a")
+	if got := <-results; got.key != "L" || got.err != nil {
+		t.Fatalf("Got %s %v for the free slot, want L", got.key, got.err)
+	}
+	q.release("K", "k")
+	for ii := 0; ii < 3; ii++ {
+		if got := <-results; got.key != "K" || got.err != errKeyReleased {
+			t.Errorf("Got %s %v, want K woken without a slot", got.key, got.err)
+		}
+	}
+	if q.running != 1 {
+		t.Errorf("%d slots held, want 1", q.running)
+	}
+}
+
+func TestDemandSharesTranscode(t *testing.T) {
+	ts := newTestServer(t)
+	config.Scheduling = "demand"
+	queue = newTranscodeQueue(2, 0, 0, true)
+	ts.mode = "short"
+	ts.writeSource(t, "a.mp4", "source")
+	first := make(chan string)
+	go func() {
+		_, body := ts.get(t, "/240p/a.mp4")
+		first <- body
+	}()
+	ts.waitCommands(t, "ffmpeg", 1)
+	// The second request waits for the first transcode rather than run
+	// its own, and gets its output once it is cached.
+	second := make(chan string)
+	go func() {
+		_, body := ts.get(t, "/240p/a.mp4")
+		second <- body
+	}()
+	<-first
+	if body := <-second; body != string(fakeOutput) {
+		t.Errorf("Got %d bytes, want the %d cached by the first transcode", len(body), len(fakeOutput))
+	}
+	if len(ts.commands("ffmpeg")) != 1 {
+		t.Errorf("Ran ffmpeg %d times, want once", len(ts.commands("ffmpeg")))
+	}
+}
+
+func TestColorTags(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeSource(t, "a.mp4", "source")
+	ts.get(t, "/240p/a.mp4")
+	if len(ts.commands("ffprobe")) > 0 {
+		t.Errorf("Probed the source without colour tags to copy: %v", ts.commands("ffprobe"))
+	}
+	if strings.Contains(ts.commands("ffmpeg")[0], "-color") {
+		t.Errorf("Tagged the output by default: %s", ts.commands("ffmpeg")[0])
+	}
+
+	ts = newTestServer(t)
+	config.ColorPrimaries = "source"
+	config.ColorSpace = "bt709"
+	ts.probe = `{"streams":[{"index":0,"codec_type":"video","codec_name":"h264","width":1920,"height":1080,"color_primaries":"bt470bg","color_space":"unknown"}],"format":{"duration":"12.5"}}`
+	ts.writeSource(t, "a.mp4", "source")
+	ts.get(t, "/240p/a.mp4")
+	if len(ts.commands("ffprobe")) != 1 {
+		t.Errorf("Probed the source %d times, want once", len(ts.commands("ffprobe")))
+	}
+	args := ts.commands("ffmpeg")[0]
+	if strings.Contains(args, "-color_primaries bt470bg") == false || strings.Contains(args, "-colorspace bt709") == false || strings.Contains(args, "-color_trc") {
+		t.Errorf("Got %s, want the source's primaries and the configured matrix", args)
+	}
+}
+
+func TestPollingOnlyIfCached(t *testing.T) {
+	ts := newTestServer(t)
+	ts.mode = "slow"
+	ts.writeSource(t, "a.mp4", "source")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/240p/a.mp4", nil)
+	resp, respErr := http.DefaultClient.Do(req)
+	if respErr != nil {
+		t.Fatal(respErr)
+	}
+	defer resp.Body.Close()
+	ts.waitCommands(t, "ffmpeg", 1)
+	resp, _ = ts.get(t, "/240p/a.mp4?attach=false")
+	if resp.StatusCode != http.StatusTooEarly || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Got status %d, want 425 with a Retry-After", resp.StatusCode)
+	}
+	resp, _ = ts.do(t, http.MethodGet, "/240p/a.mp4?attach=false", http.Header{"Cache-Control": {"only-if-cached"}})
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Got status %d, want 504", resp.StatusCode)
+	}
+	if len(ts.commands("ffmpeg")) != 1 {
+		t.Errorf("Ran ffmpeg %d times, want once", len(ts.commands("ffmpeg")))
+	}
+}
+
+func TestDegradeToAudio(t *testing.T) {
+	ts := newTestServer(t)
+	config.DegradeToAudio = true
+	ts.mode = "novideo"
+	ts.writeSource(t, "a.mp4", "source")
+	resp, body := ts.get(t, "/240p/a.mp4")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Degraded") != "audio-only" || body != string(fakeOutput) {
+		t.Fatalf("Got %d %q with %d bytes, want the audio-only output", resp.StatusCode, resp.Header.Get("X-Degraded"), len(body))
+	}
+	calls := ts.commands("ffmpeg")
+	if len(calls) != 2 || strings.Contains(calls[0], "-err_detect ignore_err -i ") == false || strings.Contains(calls[1], "-vn") == false {
+		t.Errorf("Got %q, want a transcode skipping decode errors, then one without the video", calls)
+	}
+	// Served as is from then on, under a key of its own.
+	resp, _ = ts.get(t, "/240p/a.mp4")
+	if resp.Header.Get("X-Degraded") != "audio-only" || len(ts.commands("ffmpeg")) != 2 {
+		t.Errorf("Degraded output not served from the cache")
+	}
+	if _, statErr := os.Stat(ts.cacheFile(t, "/240p/a.mp4")); statErr == nil {
+		t.Error("Degraded output cached as the full rendition")
+	}
+}
+
+func TestFFmpegLogs(t *testing.T) {
+	ts := newTestServer(t)
+	config.FFmpegLogDir = t.TempDir()
+	config.AllowPictureInPicture = true
+	ts.mode = "fail"
+	ts.writeSource(t, "a.mp4", "source")
+	for _, reqPath := range []string{"/240p/a.mp4", "/sprite/a.mp4.jpg", "/preview/a.mp4.webp", "/pip/a.mp4/a.mp4?width=240"} {
+		ts.do(t, http.MethodGet, reqPath, http.Header{"X-Request-Id": {"req-1"}})
+	}
+	data, _ := ioutil.ReadFile(path.Join(config.FFmpegLogDir, "req-1.log"))
+	if strings.Count(string(data), "Conversion failed!") != 4 {
+		t.Errorf("Got log %q, want the stderr of the four ffmpeg runs", data)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	ts := newTestServer(t)
+	config.CacheTTL.Duration = time.Hour
+	ts.writeSource(t, "a.mp4", "source")
+	previewFile := path.Join(ts.outputDir, "previews", "a.mp4.0s-3s-320w.webp")
+	os.MkdirAll(path.Dir(previewFile), os.ModePerm)
+	ioutil.WriteFile(previewFile, []byte("fresh preview"), 0644)
+	_, body := ts.get(t, "/preview/a.mp4.webp")
+	if body != "fresh preview" || len(ts.commands("ffmpeg")) > 0 {
+		t.Fatalf("Got %q, want the cached preview", body)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(previewFile, old, old)
+	_, body = ts.get(t, "/preview/a.mp4.webp")
+	if body != string(fakeOutput) || len(ts.commands("ffmpeg")) != 1 {
+		t.Errorf("Got %d bytes, want the expired preview generated again", len(body))
+	}
+}
+
+func TestSpriteKeyframes(t *testing.T) {
+	ts := newTestServer(t)
+	ts.probe = strings.Replace(testProbe, `"duration":"12.5"`, `"duration":"36000"`, 1)
+	ts.writeSource(t, "a.mp4", "source")
+	resp, _ := ts.get(t, "/sprite/a.mp4.jpg?cols=20&rows=20")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got %d, want 200", resp.StatusCode)
+	}
+	calls := ts.commands("ffmpeg")
+	if len(calls) != 1 || strings.Count(calls[0], " -i ") != 1 || strings.Contains(calls[0], "-skip_frame nokey") == false {
+		t.Errorf("Got ffmpeg calls %q, want a single input read for its keyframes", calls)
+	}
+}
+
+func TestScanInputDir(t *testing.T) {
+	ts := newTestServer(t)
+	os.Mkdir(path.Join(ts.inputDir, "sub"), os.ModePerm)
+	ts.writeSource(t, "sub/a.mp4", "source")
+	dirs := scanInputDir(nil)
+	if len(dirs) != 2 || inputFiles(dirs)["sub/a.mp4"].size != 6 {
+		t.Fatalf("Got %v, want sub/a.mp4 in two directories", inputFiles(dirs))
+	}
+	// Overwritten in place, the directory keeps its modification time.
+	subdir := path.Join(ts.inputDir, "sub")
+	info, _ := os.Stat(subdir)
+	ts.writeSource(t, "sub/a.mp4", "new source")
+	os.Chtimes(subdir, info.ModTime(), info.ModTime())
+	if size := inputFiles(scanInputDir(dirs))["sub/a.mp4"].size; size != 6 {
+		t.Errorf("Got size %d, want the unchanged directory taken from the previous scan", size)
+	}
+	if size := inputFiles(scanInputDir(nil))["sub/a.mp4"].size; size != 10 {
+		t.Errorf("Got size %d, want 10 from a full scan", size)
+	}
+	ts.writeSource(t, "sub/b.mp4", "source")
+	os.Chtimes(subdir, time.Now(), time.Now().Add(time.Second))
+	if _, ok := inputFiles(scanInputDir(dirs))["sub/b.mp4"]; ok == false {
+		t.Error("Got no sub/b.mp4, want the changed directory listed again")
+	}
+}
+
+func TestCleanFilename(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"a.mp4", "a.mp4"},
+		{"a.mp4/", "a.mp4"},
+		{"a.mp4///", "a.mp4"},
+		{"./a.mp4", "a.mp4"},
+		{"sub//a.mp4", "sub/a.mp4"},
+		{"sub/../a.mp4", "a.mp4"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"..", ""},
+		{"/", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := cleanFilename(test.raw); got != test.want {
+			t.Errorf("cleanFilename(%q) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestFilenameShapes(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeSource(t, "a.mp4", "source")
+	ts.writeCached(t, "/240p/a.mp4", "cached output")
+	if err := os.Mkdir(path.Join(ts.inputDir, "dir"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/240p/a.mp4", http.StatusOK, "cached output"},
+		{"/240p/a.mp4/", http.StatusOK, "cached output"},
+		{"/240p/./a.mp4", http.StatusOK, "cached output"},
+		{"/240p/dir", http.StatusBadRequest, "Invalid Filename"},
+		{"/240p/dir/", http.StatusBadRequest, "Invalid Filename"},
+		{"/240p/missing.mp4", http.StatusNotFound, "Not Found"},
+	}
+	for _, test := range tests {
+		resp, body := ts.get(t, test.path)
+		if resp.StatusCode != test.status || body != test.body {
+			t.Errorf("%s: got %d %q, want %d %q", test.path, resp.StatusCode, body, test.status, test.body)
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	config = JSONConfig{}
+	base := TranscodeOptions{Width: 480, Codec: "h264"}
+	with := func(change func(opts *TranscodeOptions)) TranscodeOptions {
+		opts := base
+		change(&opts)
+		return opts
+	}
+	tests := []struct {
+		name string
+		opts TranscodeOptions
+	}{
+		{"default", base},
+		{"loudnorm", with(func(opts *TranscodeOptions) { opts.Loudnorm = true })},
+		{"twopass", with(func(opts *TranscodeOptions) { opts.TwoPass, opts.Bitrate = true, "1M" })},
+		{"other bitrate", with(func(opts *TranscodeOptions) { opts.TwoPass, opts.Bitrate = true, "2M" })},
+		{"bitrate", with(func(opts *TranscodeOptions) { opts.Bitrate = "1M" })},
+		{"fps", with(func(opts *TranscodeOptions) { opts.FPS = 30 })},
+		{"loudnorm fps", with(func(opts *TranscodeOptions) { opts.Loudnorm, opts.FPS = true, 30 })},
+		{"h265", with(func(opts *TranscodeOptions) { opts.Codec = "h265" })},
+	}
+	keys := map[string]string{}
+	for _, test := range tests {
+		key := cacheKey(test.opts)
+		if other, found := keys[key]; found {
+			t.Errorf("%s and %s share the cache key %q", test.name, other, key)
+		}
+		keys[key] = test.name
+	}
+	if cacheKey(base) != "" {
+		t.Errorf("Got %q for the default options, want no key", cacheKey(base))
+	}
+}
+
+func TestEmptySource(t *testing.T) {
+	ts := newTestServer(t)
+	config.MinInputBytes = 16
+	ts.writeSource(t, "empty.mp4", "")
+	ts.writeSource(t, "small.mp4", "too small")
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/240p/empty.mp4", "Source file is empty"},
+		{"/240p/small.mp4", "Source file is too small"},
+	}
+	for _, test := range tests {
+		resp, body := ts.get(t, test.path)
+		if resp.StatusCode != http.StatusUnprocessableEntity || body != test.body {
+			t.Errorf("%s: got %d %q, want 422 %q", test.path, resp.StatusCode, body, test.body)
+		}
+	}
+	if calls := ts.commands("ffmpeg"); len(calls) != 0 {
+		t.Errorf("ran %v, want no transcode", calls)
+	}
+}
+
+func TestHead(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeSource(t, "a.mp4", "source")
+	ts.writeSource(t, "b.mp4", "source")
+	ts.writeCached(t, "/240p/a.mp4", "cached output")
+	getResp, _ := ts.get(t, "/240p/a.mp4")
+	headResp, body := ts.do(t, http.MethodHead, "/240p/a.mp4", nil)
+	if headResp.StatusCode != http.StatusOK || body != "" {
+		t.Errorf("Got %d with %q, want 200 without a body", headResp.StatusCode, body)
+	}
+	for _, name := range []string{"Content-Type", "Content-Length", "Last-Modified", "Etag"} {
+		if headResp.Header.Get(name) != getResp.Header.Get(name) {
+			t.Errorf("Got %s %q, want the GET's %q", name, headResp.Header.Get(name), getResp.Header.Get(name))
+		}
+	}
+	if headResp.Header.Get("Content-Length") != "13" || headResp.Header.Get("Etag") == "" {
+		t.Errorf("Got Content-Length %q and ETag %q for a cached file", headResp.Header.Get("Content-Length"), headResp.Header.Get("Etag"))
+	}
+
+	headResp, body = ts.do(t, http.MethodHead, "/240p/b.mp4", nil)
+	if headResp.StatusCode != http.StatusOK || body != "" || headResp.Header.Get("Content-Type") != "video/mp4" {
+		t.Errorf("Got %d %q with %q, want 200 video/mp4 without a body", headResp.StatusCode, headResp.Header.Get("Content-Type"), body)
+	}
+	config.HeadUncached = "notfound"
+	headResp, _ = ts.do(t, http.MethodHead, "/240p/b.mp4", nil)
+	if headResp.StatusCode != http.StatusNotFound {
+		t.Errorf("Got %d with HeadUncached notfound, want 404", headResp.StatusCode)
+	}
+	if len(ts.commands("ffmpeg")) > 0 {
+		t.Errorf("HEAD started a transcode")
+	}
+}
+
+func TestHTTP10(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeSource(t, "a.mp4", "source")
+	resp, body := ts.getHTTP10(t, "/240p/a.mp4", nil)
+	if resp.StatusCode != http.StatusOK || body != string(fakeOutput) {
+		t.Fatalf("Got %d with %d bytes, want 200 with ffmpeg's output", resp.StatusCode, len(body))
+	}
+	if resp.ContentLength != int64(len(fakeOutput)) || len(resp.TransferEncoding) > 0 {
+		t.Errorf("Got Content-Length %d and Transfer-Encoding %v, want %d and none", resp.ContentLength, resp.TransferEncoding, len(fakeOutput))
+	}
+	if _, statErr := os.Stat(ts.cacheFile(t, "/240p/a.mp4")); statErr != nil {
+		t.Errorf("Output not cached: %s", statErr)
+	}
+
+	// Outputs that can't be cached are streamed to the end of the
+	// connection.
+	ts.writeSource(t, "b.mp4", "source")
+	config.MinFreeBytes = 1 << 62
+	resp, body = ts.getHTTP10(t, "/240p/b.mp4", nil)
+	if resp.StatusCode != http.StatusOK || body != string(fakeOutput) {
+		t.Fatalf("Got %d with %d bytes, want 200 with ffmpeg's output", resp.StatusCode, len(body))
+	}
+	if resp.ContentLength != -1 || len(resp.TransferEncoding) > 0 || resp.Close == false {
+		t.Errorf("Got Content-Length %d, Transfer-Encoding %v and close %v, want a stream up to the close", resp.ContentLength, resp.TransferEncoding, resp.Close)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	config = JSONConfig{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(rw http.ResponseWriter, req *http.Request) {
+		panic("broken handler")
+	})
+	mux.HandleFunc("/panic-streaming", func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("partial"))
+		panic("broken stream")
+	})
+	mux.HandleFunc("/ok", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	})
+	server := httptest.NewServer(withRequestID(withRecovery(mux)))
+	defer server.Close()
+
+	resp, getErr := http.Get(server.URL + "/panic")
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Got status %d, want 500", resp.StatusCode)
+	}
+	// A response that has started can only be cut off.
+	resp, getErr = http.Get(server.URL + "/panic-streaming")
+	if getErr == nil {
+		_, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr == nil {
+			t.Error("Response completed after a panic")
+		}
+	}
+	for ii := 0; ii < 2; ii++ {
+		resp, getErr = http.Get(server.URL + "/ok")
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Errorf("Got %d %q after a panic, want 200 \"ok\"", resp.StatusCode, body)
+		}
+	}
+}
+
+func TestRangeCached(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeSource(t, "a.mp4", "source")
+	ts.writeCached(t, "/240p/a.mp4", "0123456789abcdef")
+	tests := []struct {
+		rangeHeader  string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"bytes=4-9", http.StatusPartialContent, "456789", "bytes 4-9/16"},
+		{"bytes=10-", http.StatusPartialContent, "abcdef", "bytes 10-15/16"},
+		{"bytes=-3", http.StatusPartialContent, "def", "bytes 13-15/16"},
+		{"bytes=14-100", http.StatusPartialContent, "ef", "bytes 14-15/16"},
+		{"bytes=16-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */16"},
+	}
+	for _, test := range tests {
+		resp, body := ts.do(t, http.MethodGet, "/240p/a.mp4", http.Header{"Range": {test.rangeHeader}})
+		if resp.StatusCode != test.status || resp.Header.Get("Content-Range") != test.contentRange {
+			t.Errorf("%s: got %d %q, want %d %q", test.rangeHeader, resp.StatusCode, resp.Header.Get("Content-Range"), test.status, test.contentRange)
+		}
+		if test.status == http.StatusPartialContent && (body != test.body || resp.Header.Get("Content-Length") != strconv.Itoa(len(test.body))) {
+			t.Errorf("%s: got %q (Content-Length %s), want %q", test.rangeHeader, body, resp.Header.Get("Content-Length"), test.body)
+		}
+	}
+}
+
+func TestRangeStreaming(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeSource(t, "a.mp4", "source")
+	resp, body := ts.do(t, http.MethodGet, "/240p/a.mp4", http.Header{"Range": {"bytes=4-9"}})
+	if resp.StatusCode != http.StatusOK || body != string(fakeOutput) {
+		t.Fatalf("Got %d with %d bytes, want 200 with the whole stream", resp.StatusCode, len(body))
+	}
+	if resp.Header.Get("Accept-Ranges") != "none" {
+		t.Errorf("Got Accept-Ranges %q while streaming, want none", resp.Header.Get("Accept-Ranges"))
+	}
+	resp, _ = ts.get(t, "/240p/a.mp4")
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Got Accept-Ranges %q once cached, want bytes", resp.Header.Get("Accept-Ranges"))
+	}
+}
+
+func BenchmarkSprite(b *testing.B) {
+	if _, lookErr := exec.LookPath("ffmpeg"); lookErr != nil {
+		b.Skip("ffmpeg isn't installed")
+	}
+	if _, lookErr := exec.LookPath("ffprobe"); lookErr != nil {
+		b.Skip("ffprobe isn't installed")
+	}
+	dir := b.TempDir()
+	inputFile := path.Join(dir, "source.mp4")
+	genErr := exec.Command("ffmpeg", "-v", "error", "-f", "lavfi", "-i", "testsrc2=duration=120:size=1280x720:rate=30",
+		"-c:v", "libx264", "-preset", "ultrafast", "-g", "60", inputFile).Run()
+	if genErr != nil {
+		b.Fatal(genErr)
+	}
+	config = JSONConfig{}
+	for _, accurate := range []bool{false, true} {
+		name := "keyframes"
+		if accurate {
+			name = "accurate"
+		}
+		b.Run(name, func(b *testing.B) {
+			sopts := spriteOptions{Interval: 10, Columns: 5, Rows: 5, Width: 160, Accurate: accurate}
+			spriteBase := path.Join(dir, name)
+			for ii := 0; ii < b.N; ii++ {
+				spriteErr := generateSprite(context.Background(), inputFile, sopts, spriteBase, name+".jpg", "")
+				if spriteErr != nil {
+					b.Fatal(spriteErr)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTranscodePath(t *testing.T) {
+	newTestServer(t)
+	tests := []struct {
+		path     string
+		filename string
+		width    int
+		status   int
+	}{
+		{"/240p/a.mp4", "a.mp4", 240, 0},
+		{"/240p//a.mp4", "a.mp4", 240, 0},
+		{"/240p/./a.mp4", "a.mp4", 240, 0},
+		{"/./240p/a.mp4", "a.mp4", 240, 0},
+		{"//240p/a.mp4", "a.mp4", 240, 0},
+		{"/240p/sub/../a.mp4", "a.mp4", 240, 0},
+		{"/240p/../480p/a.mp4", "a.mp4", 480, 0},
+		{"/240p/../../etc/passwd", "", 0, http.StatusNotFound},
+		{"/240p/..", "", 0, http.StatusNotFound},
+		{"/240p/", "", 0, http.StatusNotFound},
+		{"/a.mp4", "", 0, http.StatusNotFound},
+		{"/999p/a.mp4", "", 0, http.StatusNotAcceptable},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		treq, status, _ := parseTranscodeRequest(req, test.path)
+		if test.status != 0 {
+			if treq != nil || status != test.status {
+				t.Errorf("%s: got %d, want %d", test.path, status, test.status)
+			}
+			continue
+		}
+		if treq == nil {
+			t.Errorf("%s: got %d, want %s", test.path, status, test.filename)
+			continue
+		}
+		if treq.filename != test.filename || treq.opts.Width != test.width {
+			t.Errorf("%s: got %s at %d, want %s at %d", test.path, treq.filename, treq.opts.Width, test.filename, test.width)
+		}
+	}
+}
+
+func tailGrowingFile(t *testing.T, chunks []string, completed bool) (string, error) {
+	registry := newGrowingRegistry()
+	writer, createErr := ioutil.TempFile(t.TempDir(), "growing")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	source := registry.add("key", writer.Name())
+	reader, openErr := os.Open(writer.Name())
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer reader.Close()
+	go func() {
+		for _, chunk := range chunks {
+			time.Sleep(20 * time.Millisecond)
+			writer.WriteString(chunk)
+		}
+		writer.Close()
+		registry.finish("key", source, completed)
+	}()
+	data, readErr := ioutil.ReadAll(&TailingReader{file: reader, source: source, ctx: context.Background()})
+	return string(data), readErr
+}
+
+func TestTailingReader(t *testing.T) {
+	chunks := []string{"first ", "second ", "", "third"}
+	data, readErr := tailGrowingFile(t, chunks, true)
+	if readErr != nil || data != strings.Join(chunks, "") {
+		t.Errorf("Got %q, %v, want the whole file", data, readErr)
+	}
+
+	data, readErr = tailGrowingFile(t, chunks, false)
+	if readErr != errTranscodeFailed || data != strings.Join(chunks, "") {
+		t.Errorf("Got %q, %v, want what was written and errTranscodeFailed", data, readErr)
+	}
+}
+
+func TestTailingReaderCancelled(t *testing.T) {
+	writer, _ := ioutil.TempFile(t.TempDir(), "growing")
+	defer writer.Close()
+	writer.WriteString("partial")
+	reader, _ := os.Open(writer.Name())
+	defer reader.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	source := newGrowingRegistry().add("key", writer.Name())
+	data, readErr := ioutil.ReadAll(&TailingReader{file: reader, source: source, ctx: ctx})
+	if readErr != context.DeadlineExceeded || string(data) != "partial" {
+		t.Errorf("Got %q, %v, want what was written and the context's error", data, readErr)
+	}
+}
+
+func BenchmarkCacheHit(b *testing.B) {
+	ts := newTestServer(b)
+	ts.writeSource(b, "a.mp4", "source")
+	ts.writeCached(b, "/240p/a.mp4", string(fakeOutput))
+	b.SetBytes(int64(len(fakeOutput)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		resp, body := ts.get(b, "/240p/a.mp4")
+		if resp.StatusCode != http.StatusOK || len(body) != len(fakeOutput) {
+			b.Fatalf("got %d with %d bytes", resp.StatusCode, len(body))
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	ts := newTestServer(t)
+	config.AdminToken = "secret"
+	configFile = path.Join(t.TempDir(), "config.json")
+	ts.writeSource(t, "intro-v2.mp4", "source")
+	ts.writeSource(t, "private.mp4", "source")
+	ts.writeCached(t, "/240p/intro.mp4", "cached intro")
+	ts.writeCached(t, "/240p/private.mp4", "cached private")
+	admin := http.Header{"Authorization": {"Bearer secret"}}
+	reload := func(configData string) (*http.Response, string) {
+		ioutil.WriteFile(configFile, []byte(configData), 0644)
+		return ts.do(t, http.MethodPost, "/admin/reload", admin)
+	}
+
+	if resp, _ := ts.get(t, "/240p/intro.mp4"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Got %d before the Catalog maps intro.mp4, want 404", resp.StatusCode)
+	}
+	resp, body := reload(`{"Catalog": {"intro.mp4": "intro-v2.mp4"}, "Denylist": ["priv*"]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got %d %q reloading, want 200", resp.StatusCode, body)
+	}
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/240p/intro.mp4", http.StatusOK},
+		{"/240p/private.mp4", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if resp, _ := ts.get(t, test.path); resp.StatusCode != test.status {
+			t.Errorf("%s: got %d, want %d", test.path, resp.StatusCode, test.status)
+		}
+	}
+
+	// Invalid rules are rejected and the ones in use kept.
+	for _, configData := range []string{`{"Denylist": ["[priv"]}`, `{"Catalog": {"intro.mp4": "../intro.mp4"}}`, `{`} {
+		resp, body = reload(configData)
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("%s: got %d %q, want 422", configData, resp.StatusCode, body)
+		}
+	}
+	for _, test := range tests {
+		if resp, _ := ts.get(t, test.path); resp.StatusCode != test.status {
+			t.Errorf("%s after a failed reload: got %d, want %d", test.path, resp.StatusCode, test.status)
+		}
+	}
+
+	resp, _ = ts.do(t, http.MethodPost, "/admin/reload", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got %d reloading without the token, want 401", resp.StatusCode)
+	}
+}
+
+func TestProbeRotation(t *testing.T) {
+	tests := []struct {
+		stream   string
+		rotation int
+	}{
+		{`{"codec_type":"video","width":1920,"height":1080}`, 0},
+		{`{"codec_type":"video","width":1920,"height":1080,"tags":{"rotate":"90"}}`, 90},
+		{`{"codec_type":"video","width":1920,"height":1080,"tags":{"rotate":"180"}}`, 180},
+		{`{"codec_type":"video","width":1920,"height":1080,"tags":{"rotate":"-90"}}`, 270},
+		{`{"codec_type":"video","width":1920,"height":1080,"side_data_list":[{"side_data_type":"Display Matrix","rotation":-90}]}`, 90},
+		{`{"codec_type":"video","width":1920,"height":1080,"side_data_list":[{"side_data_type":"Display Matrix","rotation":90}]}`, 270},
+		{`{"codec_type":"video","width":1920,"height":1080,"side_data_list":[{"side_data_type":"Display Matrix","rotation":180.0}]}`, 180},
+		{`{"codec_type":"video","width":1920,"height":1080,"tags":{"rotate":"90"},"side_data_list":[{"side_data_type":"Display Matrix","rotation":-180}]}`, 180},
+		{`{"codec_type":"video","width":1920,"height":1080,"side_data_list":[{"side_data_type":"Display Matrix","rotation":-89.99}]}`, 90},
+	}
+	for _, test := range tests {
+		probe, parseErr := parseProbe([]byte(`{"streams":[` + test.stream + `],"format":{"duration":"12.5"}}`))
+		if parseErr != nil {
+			t.Errorf("%s: %s", test.stream, parseErr)
+			continue
+		}
+		if got := probe.videoStream().rotation(); got != test.rotation {
+			t.Errorf("%s: got %d, want %d", test.stream, got, test.rotation)
+		}
+	}
+}
+
+func TestKeepRotation(t *testing.T) {
+	tests := []struct {
+		probe string
+		scale string
+	}{
+		{testProbe, "scale=240:-2"},
+		{`{"streams":[{"codec_type":"video","width":1920,"height":1080,"side_data_list":[{"side_data_type":"Display Matrix","rotation":-90}]}],"format":{"duration":"12.5"}}`, "scale=-2:240"},
+		{`{"streams":[{"codec_type":"video","width":1920,"height":1080,"tags":{"rotate":"180"}}],"format":{"duration":"12.5"}}`, "scale=240:-2"},
+	}
+	for _, test := range tests {
+		ts := newTestServer(t)
+		config.KeepRotation = true
+		ts.probe = test.probe
+		ts.writeSource(t, "a.mp4", "source")
+		ts.get(t, "/240p/a.mp4")
+		if calls := ts.commands("ffmpeg"); len(calls) != 1 || strings.Contains(calls[0], test.scale) == false {
+			t.Errorf("%s: got %v, want %s", test.probe, calls, test.scale)
+		}
+	}
+}
+
+// countingFlusher counts the flushes passed on to a response.
+type countingFlusher struct {
+	http.Flusher
+	flushes int64
+}
+
+func (cf *countingFlusher) Flush() {
+	cf.flushes++
+	cf.Flusher.Flush()
+}
+
+// BenchmarkFlush streams 8MB in the 32KB reads of ffmpeg's pipe, flushing
+// every write as without FlushInterval and coalesced as with it.
+func BenchmarkFlush(b *testing.B) {
+	chunk := make([]byte, 32*1024)
+	const chunks = 256
+	for _, interval := range []time.Duration{0, 100 * time.Millisecond} {
+		name := "every-write"
+		if interval > 0 {
+			name = "coalesced"
+		}
+		b.Run(name, func(b *testing.B) {
+			var flushes int64
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				flusher := &countingFlusher{Flusher: rw.(http.Flusher)}
+				coalescer := newFlushCoalescer(rw, flusher, interval)
+				for ii := 0; ii < chunks; ii++ {
+					coalescer.Write(chunk)
+				}
+				coalescer.Close()
+				atomic.AddInt64(&flushes, flusher.flushes)
+			}))
+			defer server.Close()
+			b.SetBytes(int64(len(chunk) * chunks))
+			b.ResetTimer()
+			for ii := 0; ii < b.N; ii++ {
+				resp, getErr := http.Get(server.URL)
+				if getErr != nil {
+					b.Fatal(getErr)
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&flushes))/float64(b.N), "flushes/op")
+		})
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeSource(t, "a.mp4", "source")
+	ts.writeCached(t, "/240p/a.mp4", strings.Repeat("x", 30000))
+	config.MaxBytesPerSecond = 100000
+	tests := []struct {
+		burst   int64
+		minTime time.Duration
+		maxTime time.Duration
+	}{
+		// The whole file fits in the burst.
+		{30000, 0, 100 * time.Millisecond},
+		// 20000 bytes are paced at 100000 bytes per second.
+		{10000, 190 * time.Millisecond, time.Second},
+	}
+	for _, test := range tests {
+		config.BurstBytes = test.burst
+		start := time.Now()
+		resp, body := ts.get(t, "/240p/a.mp4")
+		elapsed := time.Since(start)
+		if resp.StatusCode != http.StatusOK || len(body) != 30000 {
+			t.Fatalf("burst %d: got %d with %d bytes", test.burst, resp.StatusCode, len(body))
+		}
+		if elapsed < test.minTime || elapsed > test.maxTime {
+			t.Errorf("burst %d: took %s, want between %s and %s", test.burst, elapsed, test.minTime, test.maxTime)
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	tests := []struct {
+		stream string
+		body   string
+	}{
+		{`{"codec_type":"video","width":1920,"height":1080}`, `{"width":1920,"height":1080,"rotation":0,"duration":12.5}`},
+		{`{"codec_type":"video","width":1920,"height":1080,"tags":{"rotate":"90"}}`, `{"width":1080,"height":1920,"rotation":90,"duration":12.5}`},
+		{`{"codec_type":"video","width":1920,"height":1080,"tags":{"rotate":"180"}}`, `{"width":1920,"height":1080,"rotation":180,"duration":12.5}`},
+		{`{"codec_type":"video","width":1920,"height":1080,"side_data_list":[{"side_data_type":"Display Matrix","rotation":90}]}`, `{"width":1080,"height":1920,"rotation":270,"duration":12.5}`},
+		{`{"codec_type":"audio","channels":2}`, `{"width":0,"height":0,"rotation":0,"duration":12.5}`},
+	}
+	for _, test := range tests {
+		ts := newTestServer(t)
+		ts.probe = `{"streams":[` + test.stream + `],"format":{"duration":"12.5"}}`
+		ts.writeSource(t, "a.mp4", "source")
+		resp, body := ts.get(t, "/info/a.mp4")
+		if resp.StatusCode != http.StatusOK || strings.TrimSpace(body) != test.body {
+			t.Errorf("%s: got %d %s, want %s", test.stream, resp.StatusCode, body, test.body)
+		}
+	}
+	ts := newTestServer(t)
+	resp, _ := ts.get(t, "/info/missing.mp4")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing source: got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestPrime(t *testing.T) {
+	ts := newTestServer(t)
+	config.AdminToken = "secret"
+	ts.mode = "short"
+	ts.writeSource(t, "a.mp4", "source")
+	admin := http.Header{"Authorization": {"Bearer secret"}}
+	prime := func() (int, jobStatus) {
+		resp, body := ts.do(t, http.MethodPost, "/prime/240p/a.mp4", admin)
+		var status jobStatus
+		json.Unmarshal([]byte(body), &status)
+		return resp.StatusCode, status
+	}
+
+	code, first := prime()
+	if code != http.StatusAccepted || first.ID == "" {
+		t.Fatalf("Got %d %+v priming, want 202 with a job ID", code, first)
+	}
+	// A retry while the transcode runs shares its job.
+	code, retry := prime()
+	if code != http.StatusOK || retry.ID != first.ID {
+		t.Errorf("Got %d %+v retrying, want 200 with job %s", code, retry, first.ID)
+	}
+	waitIdle(t)
+	if calls := ts.commands("ffmpeg"); len(calls) != 1 {
+		t.Errorf("ffmpeg ran %d times, want once", len(calls))
+	}
+	if _, statErr := os.Stat(ts.cacheFile(t, "/240p/a.mp4")); statErr != nil {
+		t.Errorf("Primed output not cached: %s", statErr)
+	}
+	code, cached := prime()
+	if code != http.StatusOK || cached.State != "cached" {
+		t.Errorf("Got %d %+v once cached, want 200 cached", code, cached)
+	}
+	if resp, _ := ts.do(t, http.MethodPost, "/prime/240p/a.mp4", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got %d without the token, want 401", resp.StatusCode)
+	}
+}
+
+// Canned ffprobe outputs of the sources ShortClips and StillImages are for.
+const (
+	silentProbe      = `{"streams":[{"index":0,"codec_type":"video","codec_name":"h264","width":480,"height":270,"avg_frame_rate":"15/1","nb_frames":"45"}],"format":{"duration":"3.000000"}}`
+	subSecondProbe   = `{"streams":[{"index":0,"codec_type":"video","codec_name":"h264","width":480,"height":270,"avg_frame_rate":"25/1","nb_frames":"12"}],"format":{"duration":"0.480000"}}`
+	singleFrameProbe = `{"streams":[{"index":0,"codec_type":"video","codec_name":"h264","width":1920,"height":1080,"avg_frame_rate":"25/1","nb_frames":"1"}],"format":{"duration":"0.040000"}}`
+	// MKV and WebM don't count frames.
+	singleFrameNoCountProbe = `{"streams":[{"index":0,"codec_type":"video","codec_name":"vp9","width":1920,"height":1080,"avg_frame_rate":"25/1"}],"format":{"duration":"0.040000"}}`
+)
+
+func TestProbeSamples(t *testing.T) {
+	tests := []struct {
+		probe       string
+		channels    int
+		duration    float64
+		singleFrame bool
+	}{
+		{testProbe, 2, 12.5, false},
+		{silentProbe, 0, 3, false},
+		{subSecondProbe, 0, 0.48, false},
+		{singleFrameProbe, 0, 0.04, true},
+		{singleFrameNoCountProbe, 0, 0.04, true},
+	}
+	for _, test := range tests {
+		probe, parseErr := parseProbe([]byte(test.probe))
+		if parseErr != nil {
+			t.Errorf("%s: %s", test.probe, parseErr)
+			continue
+		}
+		if probe.audioChannels() != test.channels || probe.duration() != test.duration || probe.singleFrame() != test.singleFrame {
+			t.Errorf("%s: got %d channels, %gs, single frame %v", test.probe, probe.audioChannels(), probe.duration(), probe.singleFrame())
+		}
+	}
+}
+
+func TestSilentSource(t *testing.T) {
+	ts := newTestServer(t)
+	config.Loudnorm = true
+	config.ShortClips = true
+	ts.probe = silentProbe
+	ts.writeSource(t, "a.mp4", "source")
+	resp, _ := ts.get(t, "/240p/a.mp4")
+	calls := ts.commands("ffmpeg")
+	if resp.StatusCode != http.StatusOK || len(calls) != 1 {
+		t.Fatalf("got %d after %v", resp.StatusCode, calls)
+	}
+	if strings.Contains(calls[0], "loudnorm") || strings.Contains(calls[0], "-map 0:a? ") == false {
+		t.Errorf("got %s, want an optional audio map without loudnorm", calls[0])
+	}
+	if strings.Contains(calls[0], "-g 1") {
+		t.Errorf("got %s, a 3s clip isn't short", calls[0])
+	}
+}
+
+func TestShortClip(t *testing.T) {
+	ts := newTestServer(t)
+	config.ShortClips = true
+	ts.probe = subSecondProbe
+	ts.writeSource(t, "a.mp4", "source")
+	ts.get(t, "/240p/a.mp4")
+	if calls := ts.commands("ffmpeg"); len(calls) != 1 || strings.Contains(calls[0], "-g 1 -bf 0") == false {
+		t.Errorf("got %v, want every frame a keyframe", calls)
+	}
+}
+
+func TestStillImage(t *testing.T) {
+	for _, probe := range []string{singleFrameProbe, singleFrameNoCountProbe} {
+		ts := newTestServer(t)
+		config.StillImages = true
+		ts.probe = probe
+		ts.writeSource(t, "a.mp4", "source")
+		for ii := 0; ii < 2; ii++ {
+			resp, body := ts.get(t, "/240p/a.mp4")
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" || body != string(fakeOutput) {
+				t.Errorf("%s: got %d %s", probe, resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+		}
+		calls := ts.commands("ffmpeg")
+		if len(calls) != 1 || strings.Contains(calls[0], "-frames:v 1") == false || strings.Contains(calls[0], "-c:v mjpeg") == false {
+			t.Errorf("%s: got %v, want a single JPEG", probe, calls)
+		}
+		if len(ts.commands("ffprobe")) != 1 {
+			t.Errorf("%s: probed %d times, want the still served from cache", probe, len(ts.commands("ffprobe")))
+		}
+		stillName := ts.cacheFile(t, "/240p/a.mp4") + ".jpg"
+		assertNoTempFiles(t, path.Dir(stillName), stillName)
+	}
+}
+
+func TestExtensionlessSource(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeSource(t, "clip", "source")
+	for ii := 0; ii < 2; ii++ {
+		resp, body := ts.get(t, "/240p/clip")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "video/mp4" || body != string(fakeOutput) {
+			t.Errorf("got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+	}
+	cacheFile := path.Join(ts.outputDir, "240", "clip.mp4")
+	if ts.cacheFile(t, "/240p/clip") != cacheFile {
+		t.Errorf("cached as %s, want %s", ts.cacheFile(t, "/240p/clip"), cacheFile)
+	}
+	if len(ts.commands("ffprobe")) != 1 || len(ts.commands("ffmpeg")) != 1 {
+		t.Errorf("got %v %v, want the second request served from cache", ts.commands("ffprobe"), ts.commands("ffmpeg"))
+	}
+	assertNoTempFiles(t, path.Dir(cacheFile), cacheFile)
+}
+
+func TestUnrecognizedSource(t *testing.T) {
+	ts := newTestServer(t)
+	ts.probe = ""
+	ts.writeSource(t, "notes", "not a video")
+	resp, body := ts.get(t, "/240p/notes")
+	if resp.StatusCode != http.StatusUnsupportedMediaType || body != "Unrecognized input format" {
+		t.Errorf("got %d %q, want 415", resp.StatusCode, body)
+	}
+	if len(ts.commands("ffprobe")) != 1 || len(ts.commands("ffmpeg")) != 0 {
+		t.Errorf("got %v %v, want a probe and no transcode", ts.commands("ffprobe"), ts.commands("ffmpeg"))
+	}
+
+	// Sources with an extension are transcoded without the probe's
+	// details rather than rejected.
+	ts = newTestServer(t)
+	ts.probe = ""
+	config.KeepRotation = true
+	ts.writeSource(t, "a.mp4", "source")
+	resp, _ = ts.get(t, "/240p/a.mp4")
+	if resp.StatusCode != http.StatusOK || len(ts.commands("ffmpeg")) != 1 {
+		t.Errorf("got %d after %v", resp.StatusCode, ts.commands("ffmpeg"))
+	}
+}
+
+func TestAllowedExtension(t *testing.T) {
+	newTestServer(t)
+	config.AllowedExtensions = []string{"mp4", ".MKV", ""}
+	tests := []struct {
+		filename string
+		allowed  bool
+	}{
+		{"a.mp4", true},
+		{"a.MP4", true},
+		{"a.mkv", true},
+		{"clip", true},
+		{"dir.d/clip", true},
+		{"a.avi", false},
+		{"a.mp4.txt", false},
+	}
+	for _, test := range tests {
+		if got := allowedExtension(test.filename); got != test.allowed {
+			t.Errorf("allowedExtension(%q) = %v, want %v", test.filename, got, test.allowed)
+		}
+	}
+}
+
+func TestCheckOverlap(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(path.Join(dir, "in"), os.ModePerm)
+	os.Mkdir(path.Join(dir, "out"), os.ModePerm)
+	os.Symlink(path.Join(dir, "in"), path.Join(dir, "link"))
+	tests := []struct {
+		name       string
+		inputDir   string
+		outputDir  string
+		outputDirs map[int]string
+		err        string
+	}{
+		{"apart", "in", "out", nil, ""},
+		{"same", "in", "in", nil, "Output directory {dir}/in overlaps InputDir {dir}/in"},
+		{"output inside", "in", "in/cache", nil, "Output directory {dir}/in/cache overlaps InputDir {dir}/in"},
+		{"input inside", "out/in", "out", nil, "Output directory {dir}/out overlaps InputDir {dir}/out/in"},
+		{"dot dot", "in", "out/../in/cache", nil, "Output directory {dir}/out/../in/cache overlaps InputDir {dir}/in"},
+		{"symlink", "in", "link/cache", nil, "Output directory {dir}/link/cache overlaps InputDir {dir}/in"},
+		{"similar name", "in", "in2", nil, ""},
+		{"output dirs", "in", "out", map[int]string{720: "in/720"}, "Output directory {dir}/in/720 overlaps InputDir {dir}/in"},
+	}
+	for _, test := range tests {
+		// Not joined, which would clean the paths up.
+		config = JSONConfig{InputDir: dir + "/" + test.inputDir, OutputDir: dir + "/" + test.outputDir, OutputDirs: map[int]string{}}
+		for width, outputDir := range test.outputDirs {
+			config.OutputDirs[width] = dir + "/" + outputDir
+		}
+		want := strings.ReplaceAll(test.err, "{dir}", dir)
+		overlapErr := checkOverlap()
+		if want == "" && overlapErr != nil {
+			t.Errorf("%s: got %q, want no error", test.name, overlapErr)
+		}
+		if want != "" && (overlapErr == nil || overlapErr.Error() != want) {
+			t.Errorf("%s: got %v, want %q", test.name, overlapErr, want)
+		}
+	}
+}
+
+func TestSanitizeDownloadName(t *testing.T) {
+	long := strings.Repeat("a", maxDownloadNameLength+10)
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"movie.mp4", "movie.mp4"},
+		{`my "best" clip.mp4`, `my "best" clip.mp4`},
+		{"a\r\nSet-Cookie: b.mp4", "aSet-Cookie: b.mp4"},
+		{"tab\there.mp4", "tabhere.mp4"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\Users\me\clip.mp4`, "clip.mp4"},
+		{"dir/", ""},
+		{"résumé 東京.mp4", "résumé 東京.mp4"},
+		{"\xffclip.mp4", "clip.mp4"},
+		{".hidden.mp4", "hidden.mp4"},
+		{"  spaced.mp4  ", "spaced.mp4"},
+		{"", ""},
+		{"...", ""},
+		{"\x00\x1f", ""},
+		{long + ".mp4", long[:maxDownloadNameLength-4] + ".mp4"},
+		{long, long[:maxDownloadNameLength]},
+	}
+	for _, test := range tests {
+		if got := sanitizeDownloadName(test.name); got != test.want {
+			t.Errorf("sanitizeDownloadName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDownloadHeader(t *testing.T) {
+	ts := newTestServer(t)
+	ts.writeSource(t, "a.mp4", "source")
+	ts.writeCached(t, "/240p/a.mp4", "cached output")
+	tests := []struct {
+		download string
+		status   int
+		header   string
+	}{
+		{"clip.mp4", http.StatusOK, `attachment; filename=clip.mp4`},
+		{`my "best" clip.mp4`, http.StatusOK, `attachment; filename="my \"best\" clip.mp4"`},
+		{"a\r\nb.mp4", http.StatusOK, `attachment; filename=ab.mp4`},
+		{"東京.mp4", http.StatusOK, `attachment; filename*=utf-8''%E6%9D%B1%E4%BA%AC.mp4`},
+		{"../", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		resp, _ := ts.get(t, "/240p/a.mp4?download="+url.QueryEscape(test.download))
+		if resp.StatusCode != test.status || resp.Header.Get("Content-Disposition") != test.header {
+			t.Errorf("%q: got %d %q, want %d %q", test.download, resp.StatusCode, resp.Header.Get("Content-Disposition"), test.status, test.header)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	ts := newTestServer(t)
+	config.AllowPictureInPicture = true
+	ts.writeSource(t, "a.mp4", "source")
+	ts.writeCached(t, "/240p/a.mp4", "cached output")
+	tests := []struct {
+		method string
+		path   string
+		status int
+		allow  string
+	}{
+		{http.MethodGet, "/240p/a.mp4", http.StatusOK, ""},
+		{http.MethodHead, "/240p/a.mp4", http.StatusOK, ""},
+		{http.MethodOptions, "/240p/a.mp4", http.StatusNoContent, "GET, HEAD, OPTIONS"},
+		{http.MethodOptions, "/auto/a.mp4?bandwidth=1M", http.StatusNoContent, "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/240p/a.mp4", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{http.MethodPut, "/240p/a.mp4", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{http.MethodDelete, "/240p/a.mp4", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{http.MethodPatch, "/480p/a.mp4", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/auto/a.mp4", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/sprite/a.mp4.jpg", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodPost, "/preview/a.mp4.webp", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodPost, "/pip/a.mp4/a.mp4", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodPost, "/info/a.mp4", http.StatusMethodNotAllowed, "GET, HEAD"},
+	}
+	for _, test := range tests {
+		resp, _ := ts.do(t, test.method, test.path, nil)
+		if resp.StatusCode != test.status || resp.Header.Get("Allow") != test.allow {
+			t.Errorf("%s %s: got %d with Allow %q, want %d with %q", test.method, test.path, resp.StatusCode, resp.Header.Get("Allow"), test.status, test.allow)
+		}
+	}
+	if len(ts.commands("ffmpeg")) > 0 {
+		t.Errorf("Started a transcode: %v", ts.commands("ffmpeg"))
+	}
+}
+
+// plainWriter hides the ReadFrom of the ResponseWriter, so that files
+// are copied through a buffer rather than sent with sendfile.
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+// BenchmarkServeCached serves a 16MB cached file to concurrent clients
+// through countingWriter, which passes ReadFrom on for sendfile, and
+// through a writer that doesn't.
+func BenchmarkServeCached(b *testing.B) {
+	ts := newTestServer(b)
+	cacheFile := path.Join(ts.outputDir, "large.mp4")
+	data := []byte(strings.Repeat("fake mp4 output\n", 1<<20))
+	writeErr := ioutil.WriteFile(cacheFile, data, 0644)
+	if writeErr != nil {
+		b.Fatal(writeErr)
+	}
+	wrappers := []struct {
+		name string
+		wrap func(http.ResponseWriter) http.ResponseWriter
+	}{
+		{"sendfile", func(rw http.ResponseWriter) http.ResponseWriter {
+			return &countingWriter{ResponseWriter: rw, counters: []*transcodeCounters{{}}}
+		}},
+		{"copy", func(rw http.ResponseWriter) http.ResponseWriter {
+			return plainWriter{rw}
+		}},
+	}
+	for _, wrapper := range wrappers {
+		b.Run(wrapper.name, func(b *testing.B) {
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				serveCached(wrapper.wrap(rw), req, cacheFile)
+			}))
+			defer server.Close()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, getErr := http.Get(server.URL)
+					if getErr != nil {
+						b.Error(getErr)
+						return
+					}
+					n, _ := io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK || n != int64(len(data)) {
+						b.Errorf("got %d with %d bytes", resp.StatusCode, n)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestTranscodeDeadline(t *testing.T) {
+	ts := newTestServer(t)
+	config.AllowTranscodeDeadline = true
+	ts.writeSource(t, "a.mp4", "source")
+	cacheFile := ts.cacheFile(t, "/240p/a.mp4")
+
+	resp, _ := ts.do(t, http.MethodGet, "/240p/a.mp4", http.Header{"X-Transcode-Deadline": {"soon"}})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Got status %d for an invalid deadline, want 400", resp.StatusCode)
+	}
+	resp, _ = ts.do(t, http.MethodGet, "/240p/a.mp4", http.Header{"X-Transcode-Deadline": {time.Now().Add(-time.Minute).Format(time.RFC3339)}})
+	if resp.StatusCode != http.StatusGatewayTimeout || len(ts.commands("ffmpeg")) > 0 {
+		t.Errorf("Got status %d for a past deadline, want 504 without a transcode", resp.StatusCode)
+	}
+
+	ts.mode = "slow"
+	start := time.Now()
+	resp, _ = ts.getHTTP10(t, "/240p/a.mp4", http.Header{"X-Transcode-Deadline": {"300ms"}})
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Got status %d, want 504", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Deadline of 300ms answered after %s", elapsed)
+	}
+	waitIdle(t)
+	assertExited(t, ts.pid)
+	if _, statErr := os.Stat(cacheFile); statErr == nil {
+		t.Error("Aborted output was cached")
+	}
+	assertNoTempFiles(t, path.Dir(cacheFile))
+
+	// Cached files are served whatever the deadline.
+	ioutil.WriteFile(cacheFile, []byte("cached output"), 0644)
+	resp, body := ts.do(t, http.MethodGet, "/240p/a.mp4", http.Header{"X-Transcode-Deadline": {time.Now().Add(-time.Minute).Format(time.RFC3339)}})
+	if resp.StatusCode != http.StatusOK || body != "cached output" {
+		t.Errorf("Got %d %q for a cached file, want it served", resp.StatusCode, body)
+	}
+}
+
+func TestTranscodeDeadlineQueued(t *testing.T) {
+	ts := newTestServer(t)
+	config.AllowTranscodeDeadline = true
+	queue = newTranscodeQueue(1, 0, 0, false)
+	ts.mode = "slow"
+	ts.writeSource(t, "a.mp4", "source")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/480p/a.mp4", nil)
+	resp, respErr := http.DefaultClient.Do(req)
+	if respErr != nil {
+		t.Fatal(respErr)
+	}
+	defer resp.Body.Close()
+	ts.waitCommands(t, "ffmpeg", 1)
+	// The only slot is taken, the deadline runs out in the queue.
+	resp, _ = ts.do(t, http.MethodGet, "/240p/a.mp4", http.Header{"X-Transcode-Deadline": {"200ms"}})
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Got status %d, want 504", resp.StatusCode)
+	}
+	if len(ts.commands("ffmpeg")) != 1 || queue.length() != 0 {
+		t.Errorf("Deadline passed in the queue, but ffmpeg ran %d times and %d wait", len(ts.commands("ffmpeg")), queue.length())
+	}
+}